@@ -0,0 +1,158 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+
+package main
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+//账龄区间, 按逾期天数
+var Aging_buckets = []string{"current", "1-30", "31-60", "61-90", "90+"}
+
+// whole days from the due date to the day of now, 0 on the due date itself
+func days_overdue(now time.Time, dueDate string) (int, error) {
+	due, err := parse_date(dueDate, false)
+	if err != nil {
+		return 0, err
+	}
+	today := now.Truncate(24 * time.Hour)
+	return int(today.Sub(due) / (24 * time.Hour)), nil
+}
+
+// the bucket of a loan overdue days
+func aging_bucket(overdue int) string {
+	switch {
+	case overdue <= 0:
+		return Aging_buckets[0]
+	case overdue <= 30:
+		return Aging_buckets[1]
+	case overdue <= 60:
+		return Aging_buckets[2]
+	case overdue <= 90:
+		return Aging_buckets[3]
+	}
+	return Aging_buckets[4]
+}
+
+// ============================================================================================================================
+// Get Aging Report - the outstanding loans of an organization by days past the due date, at the transaction time
+//
+// A loan is outstanding from BankCheck until BankRecv succeeds. Its amount is in the loan currency, and for a bank
+// sharing a syndication only its own tranche. Totals are by bucket, then by supplier (the holder) and by core
+// enterprise (who approved the receivable), keyed by user id. Loans of marbles without a due date cannot be aged
+// and are counted in "no_due_date". The marbles are found with the stats index, see get_portfolio_stats; who may
+// read which organization is the same too.
+//
+// Inputs - Array of strings
+//         0
+//   company (optional)
+//     "bank"
+// ============================================================================================================================
+func get_aging_report(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	type Aging struct {
+		AsOf             string                           `json:"as_of"`
+		Company          string                           `json:"company"`
+		Buckets          []string                         `json:"buckets"`
+		Total            map[string]*StatTotal            `json:"total"`
+		BySupplier       map[string]map[string]*StatTotal `json:"by_supplier"`
+		ByCoreEnterprise map[string]map[string]*StatTotal `json:"by_core_enterprise"`
+		NoDueDate        StatTotal                        `json:"no_due_date"`
+		Unavailable      []string                         `json:"unavailable,omitempty"`
+	}
+
+	if len(args) > 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 0 or 1")
+	}
+	company, err := report_company(stub, args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	now, err := get_tx_time(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	report := Aging{AsOf: now.Format(DateLayout), Company: company, Buckets: Aging_buckets}
+	report.Total = map[string]*StatTotal{}
+	report.BySupplier = map[string]map[string]*StatTotal{}
+	report.ByCoreEnterprise = map[string]map[string]*StatTotal{}
+	for _, bucket := range Aging_buckets {
+		report.Total[bucket] = &StatTotal{}
+	}
+
+	resultsIterator, err := stub.GetStateByPartialCompositeKey("stats", []string{company, Step_name[BankCheck], Review_name[Success]})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer resultsIterator.Close()
+	for resultsIterator.HasNext() {
+		aKeyValue, err := resultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		_, keyParts, err := stub.SplitCompositeKey(aKeyValue.Key)
+		if err != nil || len(keyParts) != 5 {
+			continue
+		}
+		marble, err := get_marble(stub, keyParts[4])
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if marble.Check[BankRecv].Review == Success {
+			continue                                           //repaid
+		}
+
+		amount, err := loan_amount(stub, marble, BankCheck)
+		if err != nil {
+			report.Unavailable = append(report.Unavailable, marble.Id)
+			continue
+		}
+		if marble.Syndication != nil {
+			for _, tranche := range marble.Syndication.Tranches {
+				if tranche.Company == company && tranche.Status == "approved" {
+					amount = tranche.Amount
+				}
+			}
+		}
+		currency := marble.LoanCurrency
+		if currency == "" {
+			currency = marble.Currency
+		}
+		if marble.DueDate == "" {
+			report.NoDueDate.add(currency, amount)
+			continue
+		}
+		overdue, err := days_overdue(now, marble.DueDate)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		bucket := aging_bucket(overdue)
+		report.Total[bucket].add(currency, amount)
+		add_stat(report.BySupplier, marble.User.Id, bucket, currency, amount)
+		add_stat(report.ByCoreEnterprise, marble.Check[CompanyCheck].UserID, bucket, currency, amount)
+	}
+
+	reportAsBytes, _ := json.Marshal(report)
+	return shim.Success(reportAsBytes)
+}
@@ -0,0 +1,203 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sort"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// ============================================================================================================================
+// Hash chain of decisions
+//
+// Every CheckInfo that gets decided (review success or failure) is sealed once: it gets the next sequence number, the
+// hash of the decision sealed before it and its own hash over both. The marble keeps the last hash as chain_head, so
+// changing, removing or reordering any decision afterwards breaks the chain.
+//
+// The hash is sha256 over the JSON of ChainEntry below, lower case hex. Fields are taken as stored on the ledger (an
+// encrypted comment is hashed encrypted), so an exported marble can be checked offline. Keep marblesverify in step
+// with any change here.
+// ============================================================================================================================
+type ChainEntry struct {
+	MarbleId   string      `json:"marble_id"`
+	Seq        int         `json:"seq"`
+	PrevHash   string      `json:"prev_hash"`
+	Step       int         `json:"step"`
+	UserID     string      `json:"userid"`
+	Company    string      `json:"company"`
+	Date       string      `json:"date"`
+	Review     int         `json:"review"`
+	Comment    string      `json:"comment"`
+	Signatures []Signature `json:"signatures"`
+}
+
+func chain_hash(marbleId string, step int, check CheckInfo) string {
+	entry := ChainEntry{
+		MarbleId:   marbleId,
+		Seq:        check.Seq,
+		PrevHash:   check.PrevHash,
+		Step:       step,
+		UserID:     check.UserID,
+		Company:    check.Company,
+		Date:       check.Date,
+		Review:     check.Review,
+		Comment:    check.Comment,
+		Signatures: check.Signatures,
+	}
+	if len(entry.Signatures) == 0 {
+		entry.Signatures = nil                               //stored with omitempty, an empty list reads back as null
+	}
+	entryAsBytes, _ := json.Marshal(entry)
+	hash := sha256.Sum256(entryAsBytes)
+	return hex.EncodeToString(hash[:])
+}
+
+func is_decided(check CheckInfo) bool {
+	return check.Review == Success || check.Review == Failure
+}
+
+// steps in the order they are sealed when several are decided by one transaction: route order, then the rest
+func chain_order(marble Marble) []int {
+	route := marble.Route
+	if len(route) == 0 {
+		route = base_route(marble)
+	}
+	seen := map[int]bool{}
+	var steps []int
+	for _, step := range route {
+		if step >= 0 && step < StepNum && !seen[step] {
+			seen[step] = true
+			steps = append(steps, step)
+		}
+	}
+	for step := 0; step < StepNum; step++ {
+		if !seen[step] {
+			steps = append(steps, step)
+		}
+	}
+	return steps
+}
+
+// ============================================================================================================================
+// Seal Decisions - add the decisions made since the last write to the hash chain, called by put_marble
+// ============================================================================================================================
+func seal_decisions(marble *Marble) {
+	seq := 0
+	for _, check := range marble.Check {
+		if check.Seq > seq {
+			seq = check.Seq
+		}
+	}
+	for _, step := range chain_order(*marble) {
+		check := &marble.Check[step]
+		if !is_decided(*check) || check.Hash != "" {
+			continue
+		}
+		seq++
+		check.Seq = seq
+		check.PrevHash = marble.ChainHead
+		check.Hash = chain_hash(marble.Id, step, *check)
+		marble.ChainHead = check.Hash
+	}
+}
+
+// ============================================================================================================================
+// Check Chain - recompute the hash chain of a marble, returns the problems found (none when intact)
+// ============================================================================================================================
+func check_chain(marble Marble) []string {
+	problems := []string{}
+	var steps []int
+	for step, check := range marble.Check {
+		if check.Seq > 0 || check.Hash != "" {
+			steps = append(steps, step)
+		} else if is_decided(check) {
+			problems = append(problems, "step "+Step_name[step]+" is decided but not sealed")
+		}
+	}
+	sort.SliceStable(steps, func(i, j int) bool {
+		return marble.Check[steps[i]].Seq < marble.Check[steps[j]].Seq
+	})
+
+	prev := ""
+	for i, step := range steps {
+		check := marble.Check[step]
+		name := Step_name[step]
+		if check.Seq != i+1 {
+			problems = append(problems, "step "+name+" has seq "+strconv.Itoa(check.Seq)+", expected "+strconv.Itoa(i+1))
+		}
+		if check.PrevHash != prev {
+			problems = append(problems, "step "+name+" does not link to the previous decision")
+		}
+		if !is_decided(check) {
+			problems = append(problems, "step "+name+" is sealed but no longer decided")
+		}
+		if chain_hash(marble.Id, step, check) != check.Hash {
+			problems = append(problems, "step "+name+" was changed after it was sealed")
+		}
+		prev = check.Hash
+	}
+	if marble.ChainHead != prev {
+		problems = append(problems, "chain head does not match the last decision")
+	}
+	return problems
+}
+
+// ============================================================================================================================
+// Verify Marble Chain - check that no decision of a marble was altered
+//
+// Inputs - Array of strings
+//         0
+//     marble id
+//  "m1490898165086"
+// ============================================================================================================================
+func verify_marble_chain(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	type ChainReport struct {
+		Id       string   `json:"id"`
+		Valid    bool     `json:"valid"`
+		Length   int      `json:"length"`
+		Head     string   `json:"head"`
+		Problems []string `json:"problems"`
+	}
+
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+	marble, err := get_marble(stub, args[0])              //as stored, not decrypted
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	report := ChainReport{Id: marble.Id, Head: marble.ChainHead, Problems: check_chain(marble)}
+	report.Valid = len(report.Problems) == 0
+	for _, check := range marble.Check {
+		if check.Seq > report.Length {
+			report.Length = check.Seq
+		}
+	}
+	reportAsBytes, _ := json.Marshal(report)
+	return shim.Success(reportAsBytes)
+}
@@ -0,0 +1,303 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// ============================================================================================================================
+// Dynamic Discounting - the core enterprise pays the supplier early from its own cash, less a discount
+//
+// Once the core enterprise has approved a receivable with a due date, and before any bank finances it, the core
+// enterprise may offer to pay early: either an annual rate (apr_bps) that earns pro-rata for every day paid early,
+// or a sliding scale of fixed rates by how many days early. When the supplier accepts, the discount is worked out
+// from the days left until the due date at the transaction timestamp, in integer arithmetic rounded down, and the
+// marble ends successfully without a bank stage. Private and encrypted marbles are not offered, the amounts would
+// have to be written to the public state.
+// ============================================================================================================================
+
+// normalize a due date to 2006-01-02
+func parse_due_date(s string) (string, error) {
+	t, err := parse_date(s, false)
+	if err != nil {
+		return "", err
+	}
+	return t.Format("2006-01-02"), nil
+}
+
+// whole days from the transaction time until the start of the due date, negative once it is due
+func days_early(now time.Time, dueDate string) (int, error) {
+	due, err := parse_date(dueDate, false)
+	if err != nil {
+		return 0, err
+	}
+	d := due.Sub(now)
+	days := int(d / (24 * time.Hour))
+	if d < 0 && d%(24*time.Hour) != 0 {
+		days--                                  //round down, not towards zero
+	}
+	return days, nil
+}
+
+// check the terms of an offer, exactly one of an annual rate or a sliding scale
+func check_discount_terms(d Discount) error {
+	if (d.AprBps == 0) == (len(d.Scale) == 0) {
+		return errors.New("the offer needs either apr_bps or scale")
+	}
+	if d.AprBps < 0 || d.AprBps > 10000 {
+		return errors.New("apr_bps must be between 1 and 10000")
+	}
+	for i, tier := range d.Scale {
+		if tier.MinDaysEarly <= 0 || tier.RateBps <= 0 || tier.RateBps >= 10000 {
+			return errors.New("tier " + strconv.Itoa(i) + " needs min_days_early > 0 and rate_bps between 1 and 9999")
+		}
+		if i > 0 && tier.MinDaysEarly <= d.Scale[i-1].MinDaysEarly {
+			return errors.New("tiers must be sorted by min_days_early, without repeats")
+		}
+	}
+	return nil
+}
+
+// ============================================================================================================================
+// Discount Amount - the discount on balance paid days early, and the rate of the balance it comes to in bps
+//
+// apr_bps: balance * apr_bps * days / (10000 * 365). scale: balance * rate_bps / 10000 of the last tier reached.
+// Both round down, so the supplier never gets less than the exact figure, and never more than the balance is taken
+// off. offer_discount refuses annual rates that would take it all.
+// ============================================================================================================================
+func discount_amount(d Discount, balance int, days int) (int, int) {
+	if days <= 0 || balance <= 0 {
+		return 0, 0
+	}
+	numerator := big.NewInt(int64(balance))
+	denominator := big.NewInt(10000)
+	rate := int64(0)
+	if d.AprBps > 0 {
+		numerator.Mul(numerator, big.NewInt(int64(d.AprBps)*int64(days)))
+		denominator.Mul(denominator, big.NewInt(365))
+		rate = int64(d.AprBps) * int64(days) / 365
+	} else {
+		for _, tier := range d.Scale {
+			if days >= tier.MinDaysEarly {
+				rate = int64(tier.RateBps)
+			}
+		}
+		numerator.Mul(numerator, big.NewInt(rate))
+	}
+	amount := numerator.Quo(numerator, denominator)
+	if rate >= 10000 || amount.Cmp(big.NewInt(int64(balance))) > 0 {
+		return balance, 10000
+	}
+	return int(amount.Int64()), int(rate)
+}
+
+// the marble can still be paid early: approved by the core enterprise, not financed nor closed
+func check_discountable(marble Marble) error {
+	if err := check_marble_active(marble); err != nil {
+		return err
+	}
+	if marble.PrivateHash != "" || marble.Encrypted {
+		return errors.New("marble " + marble.Id + " keeps its terms private, it cannot be discounted")
+	}
+	if marble.DueDate == "" {
+		return errors.New("marble " + marble.Id + " has no due date")
+	}
+	if marble.Check[EndOf].Review != Disable || marble.Check[BankCheck].Review == Success {
+		return errors.New("marble " + marble.Id + " is already financed or closed")
+	}
+	if marble.Check[CompanyCheck].Review != Success || marble.Check[New].Review != Success {
+		return errors.New("marble " + marble.Id + " is not approved by the core enterprise and the supplier yet")
+	}
+	if marble.Syndication != nil {
+		return errors.New("marble " + marble.Id + " is being syndicated to banks")
+	}
+	if t := pending_title(&marble); t != nil {
+		return errors.New("marble " + marble.Id + " has a transfer to " + t.To + " waiting")
+	}
+	return nil
+}
+
+// ============================================================================================================================
+// Offer Discount - the core enterprise offers to pay a receivable early, replaces an offer not yet accepted
+//
+// Inputs - Array of strings
+//        0      ,          1          ,                        2                                   ,      3
+//    marble id  , core user / company ,                      terms                                 , expires (optional)
+//  "m999999999" ,  "core-enterprise"  ,               '{"apr_bps": 1200}'                          ,  "2018-06-30"
+//  "m999999999" ,  "core-enterprise"  , '{"scale":[{"min_days_early":30,"rate_bps":100},{"min_days_early":60,"rate_bps":250}]}'
+// ============================================================================================================================
+func offer_discount(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	fmt.Println("starting offer_discount")
+
+	if len(args) != 3 && len(args) != 4 {
+		return shim.Error("Incorrect number of arguments. Expecting 3 or 4")
+	}
+	coreID := args[1]
+	if _, err := get_user(stub, coreID); err != nil {
+		userC, _ := getUserByCompany(stub, coreID)
+		coreID = userC.Id
+	}
+	core, err := get_user(stub, coreID)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if !core.Enabled || core.Company != Step_company[CompanyCheck] {
+		return shim.Error("only the core enterprise can offer early payment")
+	}
+	marble, err := get_marble(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = check_discountable(marble)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	var offer Discount
+	err = json.Unmarshal([]byte(args[2]), &offer)
+	if err != nil {
+		return shim.Error("3rd argument must be the terms as JSON, " + err.Error())
+	}
+	err = check_discount_terms(offer)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	now, err := get_tx_time(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	days, err := days_early(now, marble.DueDate)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if int64(offer.AprBps)*int64(days) >= 10000*365 {        //days only get fewer until it is accepted
+		return shim.Error("apr_bps " + strconv.Itoa(offer.AprBps) + " over " + strconv.Itoa(days) + " days early would discount the whole balance")
+	}
+	offer.Expires = ""
+	if len(args) == 4 {
+		expires, err := parse_date(args[3], true)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if !expires.After(now) {
+			return shim.Error("the offer would expire before it is made")
+		}
+		offer.Expires = expires.Format(DateLayout)
+	}
+	offer.OfferedBy = core.Id
+	offer.OfferedAt = now.Format(DateLayout)
+	offer.Status = "offered"
+	offer.AcceptedBy, offer.AcceptedAt = "", ""
+	offer.DaysEarly, offer.RateBps, offer.Amount, offer.Paid = 0, 0, 0, 0
+	marble.Discount = &offer
+
+	jsonAsBytes, err := put_marble(stub, marble)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	fmt.Println("- end offer_discount")
+	return shim.Success(jsonAsBytes)
+}
+
+// ============================================================================================================================
+// Accept Discount - the supplier takes the early payment, the marble is settled and ends
+//
+// The stage that was waiting (usually BankCheck) is dropped, EndOf succeeds with the core enterprise as the payer.
+//
+// Inputs - Array of strings
+//        0      ,      1
+//    marble id  ,  supplier id
+//  "m999999999" ,  "o1111"
+// ============================================================================================================================
+func accept_discount(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	fmt.Println("starting accept_discount")
+
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 2")
+	}
+	err := sanitize_arguments(args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	marble, err := get_marble(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	supplier, err := get_user(stub, args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if !supplier.Enabled || supplier.Id != marble.User.Id {
+		return shim.Error("only the supplier holding marble " + marble.Id + " can accept the offer")
+	}
+	err = check_discountable(marble)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	offer := marble.Discount
+	if offer == nil || offer.Status != "offered" {
+		return shim.Error("there is no offer on marble " + marble.Id)
+	}
+
+	now, err := get_tx_time(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	date := now.Format(DateLayout)
+	if offer.Expires != "" && date > offer.Expires {
+		return shim.Error("the offer expired at " + offer.Expires)
+	}
+	days, err := days_early(now, marble.DueDate)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if days <= 0 {
+		return shim.Error("marble " + marble.Id + " is due on " + marble.DueDate + ", it can no longer be paid early")
+	}
+	offer.DaysEarly = days
+	offer.Amount, offer.RateBps = discount_amount(*offer, marble.Balance, days)
+	offer.Paid = marble.Balance - offer.Amount
+	offer.Status = "accepted"
+	offer.AcceptedBy = supplier.Id
+	offer.AcceptedAt = date
+
+	if step := pending_step(marble); step >= 0 {
+		marble.Check[step].Review = Disable                    //no bank stage, the core enterprise pays
+	}
+	end_marble(&marble, Success, offer.OfferedBy, Step_company[CompanyCheck],
+		"paid early by the core enterprise: "+strconv.Itoa(offer.Paid)+" of "+strconv.Itoa(marble.Balance)+", "+strconv.Itoa(days)+" days early", date)
+
+	jsonAsBytes, err := put_marble(stub, marble)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	fmt.Println("- end accept_discount")
+	return shim.Success(jsonAsBytes)
+}
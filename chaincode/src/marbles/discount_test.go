@@ -0,0 +1,96 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestDiscountAmount(t *testing.T) {
+	scale := Discount{Scale: []DiscountTier{{MinDaysEarly: 30, RateBps: 100}, {MinDaysEarly: 60, RateBps: 250}}}
+	tests := []struct {
+		name    string
+		offer   Discount
+		balance int
+		days    int
+		amount  int
+		rate    int
+	}{
+		{"apr one year", Discount{AprBps: 1200}, 10000, 365, 1200, 1200},
+		{"apr 30 days", Discount{AprBps: 1200}, 10000, 30, 98, 98}, //98.63 rounded down
+		{"apr rounds down", Discount{AprBps: 1}, 100, 1, 0, 0},
+		{"apr not early", Discount{AprBps: 1200}, 10000, 0, 0, 0},
+		{"apr late", Discount{AprBps: 1200}, 10000, -5, 0, 0},
+		{"apr whole balance", Discount{AprBps: 10000}, 10000, 365, 10000, 10000},
+		{"apr capped at the balance", Discount{AprBps: 10000}, 10000, 3650, 10000, 10000},
+		{"apr large balance", Discount{AprBps: 1000}, math.MaxInt64 / 2, 365, math.MaxInt64 / 20, 1000},
+		{"scale below the first tier", scale, 10000, 29, 0, 0},
+		{"scale first tier", scale, 10000, 30, 100, 100},
+		{"scale last tier", scale, 10000, 90, 250, 250},
+		{"scale rounds down", scale, 399, 60, 9, 250},
+		{"no balance", Discount{AprBps: 1200}, 0, 30, 0, 0},
+	}
+	for _, test := range tests {
+		amount, rate := discount_amount(test.offer, test.balance, test.days)
+		if amount != test.amount || rate != test.rate {
+			t.Errorf("%s: got %d at %d bps, want %d at %d bps", test.name, amount, rate, test.amount, test.rate)
+		}
+		if amount < 0 || amount > test.balance && test.balance > 0 {
+			t.Errorf("%s: discount %d outside the balance %d", test.name, amount, test.balance)
+		}
+	}
+}
+
+func TestDaysEarly(t *testing.T) {
+	at := func(s string) time.Time {
+		now, err := time.Parse(DateLayout, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return now
+	}
+	tests := []struct {
+		now  string
+		due  string
+		days int
+	}{
+		{"2018-06-01 00:00:00", "2018-06-30", 29},
+		{"2018-06-01 12:00:00", "2018-06-30", 28},
+		{"2018-06-29 23:59:59", "2018-06-30", 0},
+		{"2018-06-30 00:00:00", "2018-06-30", 0},
+		{"2018-06-30 00:00:01", "2018-06-30", -1},
+		{"2018-07-02 00:00:00", "2018-06-30", -2},
+		{"2018-02-28 00:00:00", "2018-03-01", 1},
+	}
+	for _, test := range tests {
+		days, err := days_early(at(test.now), test.due)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if days != test.days {
+			t.Errorf("%s to %s: %d days, want %d", test.now, test.due, days, test.days)
+		}
+	}
+	if _, err := days_early(at("2018-06-01 00:00:00"), "30/06/2018"); err == nil {
+		t.Error("a malformed due date was accepted")
+	}
+}
@@ -0,0 +1,313 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// ============================================================================================================================
+// Open Dispute - freeze a marble whose receivable is contested
+//
+// Any enabled participant of the marble may open a dispute while the marble is running. Until the dispute is
+// resolved no workflow transition (review, expiry, escalation, deletion) is possible.
+//
+// Inputs - Array of Strings
+//        0      ,    1    ,           2
+//    marble id  , user id ,         reason
+//   "m999999999", "o222"  , "goods were defective"
+// ============================================================================================================================
+func open_dispute(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var err error
+	fmt.Println("starting open_dispute")
+
+	if len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting 3")
+	}
+
+	//input sanitation, the reason may be longer than 32 characters
+	err = sanitize_arguments(args[:2])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if len(args[2]) == 0 {
+		return shim.Error("Argument 2 must be a non-empty string")
+	}
+
+	marble, user, err := get_dispute_party(stub, args[0], args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = check_marble_active(marble)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if marble.Check[EndOf].Review != Disable {
+		return shim.Error("marble " + marble.Id + " has already ended")
+	}
+
+	date, err := get_tx_date(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	var dispute Dispute
+	dispute.OpenedBy = user.Id
+	dispute.Company = user.Company
+	dispute.Reason = args[2]
+	dispute.Date = date
+	dispute.Step = pending_step(marble)
+	dispute.Evidence = []Evidence{}
+	dispute.Status = "open"
+	dispute.OldBalance = marble.Balance
+	dispute.NewBalance = marble.Balance
+	marble.Disputes = append(marble.Disputes, dispute)
+	marble.Status = Disputed
+
+	jsonAsBytes, err := put_marble(stub, marble)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("- end open_dispute")
+	return shim.Success(jsonAsBytes)
+}
+
+// ============================================================================================================================
+// Add Dispute Evidence - attach the hash of a document and a comment to the open dispute
+//
+// Inputs - Array of Strings
+//        0      ,    1    ,                 2                ,         3
+//    marble id  , user id ,          sha256 (hex)            ,      comment
+//   "m999999999", "o222"  , "9f86d081884c7d659a2feaa0c55..." , "inspection report"
+// ============================================================================================================================
+func add_dispute_evidence(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var err error
+	fmt.Println("starting add_dispute_evidence")
+
+	if len(args) != 4 {
+		return shim.Error("Incorrect number of arguments. Expecting 4")
+	}
+
+	//input sanitation, hash and comment may be longer than 32 characters
+	err = sanitize_arguments(args[:2])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if !is_sha256_hex(args[2]) {
+		return shim.Error("3rd argument must be a hex encoded sha256 hash")
+	}
+
+	marble, user, err := get_dispute_party(stub, args[0], args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if marble.Status != Disputed {
+		return shim.Error("marble " + marble.Id + " has no open dispute")
+	}
+
+	date, err := get_tx_date(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	var evidence Evidence
+	evidence.Hash = args[2]
+	evidence.Comment = args[3]
+	evidence.UserID = user.Id
+	evidence.Date = date
+	dispute := &marble.Disputes[len(marble.Disputes)-1]
+	dispute.Evidence = append(dispute.Evidence, evidence)
+
+	jsonAsBytes, err := put_marble(stub, marble)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("- end add_dispute_evidence")
+	return shim.Success(jsonAsBytes)
+}
+
+// ============================================================================================================================
+// Resolve Dispute - settle the open dispute, the bank acts as arbiter
+//
+// "resume"    - the marble continues from the stage it was frozen at, with the adjusted balance. A pending deadline
+//               is moved by the time the marble spent disputed.
+// "terminate" - the pending stage fails and the marble ends with the adjusted balance.
+//
+// Inputs - Array of Strings
+//        0      ,    1    ,           2           ,         3        ,        4
+//    marble id  , user id ,  "resume"/"terminate"  , adjusted balance ,     comment
+//   "m999999999", "o333"  ,        "resume"        ,      "30"        , "credit note for 5 accepted"
+//
+// For a marble with private terms, or an encrypted one, pass "0" as adjusted balance and {"balance": 30} as transient
+// "marble_private", so the amount is not recorded in the transaction. An encrypted marble also needs its "marble_key".
+// ============================================================================================================================
+func resolve_dispute(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var err error
+	fmt.Println("starting resolve_dispute")
+
+	if len(args) != 5 {
+		return shim.Error("Incorrect number of arguments. Expecting 5")
+	}
+
+	//input sanitation, the comment may be longer than 32 characters
+	err = sanitize_arguments(args[:4])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	outcome := args[2]
+	if outcome != "resume" && outcome != "terminate" {
+		return shim.Error("3rd argument must be 'resume' or 'terminate'")
+	}
+	balance, err := strconv.Atoi(args[3])
+	if err != nil || balance < 0 {
+		return shim.Error("4th argument must be a non-negative numeric string")
+	}
+
+	user, err := get_user(stub, args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if !user.Enabled || user.Company != Step_company[BankCheck] {
+		return shim.Error("user :" + user.Id + " cannot resolve disputes")
+	}
+	marble, err := get_marble(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if marble.Status != Disputed {
+		return shim.Error("marble " + marble.Id + " has no open dispute")
+	}
+	var private MarblePrivate
+	adjusted := balance                                        //the public balance stays 0 for private and encrypted
+	if marble.PrivateHash != "" || marble.Encrypted {
+		input, ok, err := get_private_input(stub)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if !ok || balance != 0 || input.Balance < 0 {
+			return shim.Error("the adjusted balance of a private or encrypted marble must be passed in the transient map")
+		}
+		adjusted = input.Balance
+	}
+	if marble.PrivateHash != "" {
+		private, err = get_marble_private(stub, marble.Id)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if adjusted > private.Balance {
+			return shim.Error("the adjusted balance can not exceed the balance")
+		}
+		private.Balance = adjusted
+	} else if marble.Encrypted {
+		current, err := encrypted_balance(stub, marble)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if adjusted > current {
+			return shim.Error("the adjusted balance can not exceed the balance")
+		}
+	} else if balance > marble.Balance {
+		return shim.Error("the adjusted balance can not exceed the balance " + strconv.Itoa(marble.Balance))
+	}
+
+	now, err := get_tx_time(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	date := now.Format(DateLayout)
+
+	dispute := &marble.Disputes[len(marble.Disputes)-1]
+	dispute.ResolvedBy = user.Id
+	dispute.ResolvedAt = date
+	dispute.Comment = args[4]
+	dispute.NewBalance = balance
+	marble.Balance = balance
+	marble.Status = ""
+	if marble.PrivateHash != "" {
+		err = put_marble_private(stub, &marble, private)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+	if marble.Encrypted {
+		key, err := get_marble_key_for(stub, marble)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		marble.BalanceEnc, err = encrypt_field(stub, key, marble.Id, "balance", "balance", strconv.Itoa(adjusted))
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	step := pending_step(marble)
+	if outcome == "resume" {
+		dispute.Status = "resumed"
+		if step >= 0 && marble.Check[step].Deadline != "" {
+			opened, err1 := time.Parse(DateLayout, dispute.Date)
+			deadline, err2 := time.Parse(DateLayout, marble.Check[step].Deadline)
+			if err1 == nil && err2 == nil {
+				marble.Check[step].Deadline = deadline.Add(now.Sub(opened)).Format(DateLayout)
+			}
+		}
+	} else {
+		dispute.Status = "terminated"
+		if step >= 0 {
+			marble.Check[step].Review = Failure
+			marble.Check[step].Date = date
+			marble.Check[step].Comment = "terminated by dispute resolution"
+		}
+		end_marble(&marble, Failure, user.Id, user.Company, "the transaction is end failure, dispute: "+args[4], date)
+	}
+
+	jsonAsBytes, err := put_marble(stub, marble)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("- end resolve_dispute")
+	return shim.Success(jsonAsBytes)
+}
+
+// get the marble and check the user is an enabled participant of it
+func get_dispute_party(stub shim.ChaincodeStubInterface, marbleId string, userID string) (Marble, User, error) {
+	user, err := get_user(stub, userID)
+	if err != nil {
+		return Marble{}, user, err
+	}
+	marble, err := get_marble(stub, marbleId)
+	if err != nil {
+		return marble, user, err
+	}
+	if !user.Enabled || !is_participant(marble, user.Id) {
+		return marble, user, errors.New("user :" + user.Id + " is not a party of marble " + marble.Id)
+	}
+	return marble, user, nil
+}
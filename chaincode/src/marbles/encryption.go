@@ -0,0 +1,252 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// Field-level encryption for channels without private data collections.
+//
+// The client passes a 32 byte AES-256 key in the transient map under "marble_key". Contact, balance and review
+// comments of the marble are then kept in the world state as "enc:" + base64(nonce | AES-GCM ciphertext). The nonce is derived from
+// the key, the tx id, the marble id and the value's slot so every endorsing peer produces the same ciphertext and no
+// nonce is used twice. The marble id and field are the associated data, so a ciphertext copied to another marble or
+// field does not decrypt. The marble records a key id (not the key) so a wrong key is rejected instead of writing data
+// nobody can read.
+
+// ============================================================================================================================
+// Get Marble Key - the AES-256 key passed in the transient map, if any
+// ============================================================================================================================
+func get_marble_key(stub shim.ChaincodeStubInterface) ([]byte, bool, error) {
+	transient, err := stub.GetTransient()
+	if err != nil {
+		return nil, false, errors.New("Failed to get the transient map")
+	}
+	key, ok := transient["marble_key"]
+	if !ok {
+		return nil, false, nil
+	}
+	if len(key) != 32 {
+		return nil, false, errors.New("transient marble_key must be 32 bytes")
+	}
+	return key, true, nil
+}
+
+// identifies a key without revealing it
+func key_id(key []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("marble key id"))
+	return hex.EncodeToString(mac.Sum(nil))[:16]
+}
+
+// get the transient key and check it is the one the marble was encrypted with
+func get_marble_key_for(stub shim.ChaincodeStubInterface, marble Marble) ([]byte, error) {
+	key, ok, err := get_marble_key(stub)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, errors.New("marble " + marble.Id + " is encrypted, pass its key as transient marble_key")
+	}
+	if key_id(key) != marble.KeyId {
+		return nil, errors.New("transient marble_key is not the key of marble " + marble.Id)
+	}
+	return key, nil
+}
+
+// ============================================================================================================================
+// Encrypt Field - AES-GCM encrypt one value with a nonce derived from key, tx id, marble id and slot
+//
+// The slot tells apart the values of one marble encrypted in the same transaction (e.g. "comment.1"), a batch
+// encrypts many marbles in one transaction so the marble id is part of it too. The associated data is the marble id
+// and the field name, see field_aad.
+// ============================================================================================================================
+func encrypt_field(stub shim.ChaincodeStubInterface, key []byte, marbleId string, slot string, field string, plaintext string) (string, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return "", err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", err
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(stub.GetTxID() + "|" + marbleId + "|" + slot))
+	nonce := mac.Sum(nil)[:gcm.NonceSize()]
+
+	sealed := gcm.Seal(append([]byte{}, nonce...), nonce, []byte(plaintext), field_aad(marbleId, field))
+	return "enc:" + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// the GCM associated data of a value, binds the ciphertext to its marble and field
+func field_aad(marbleId string, field string) []byte {
+	return []byte(marbleId + "|" + field)
+}
+
+// ============================================================================================================================
+// Decrypt Field - reverse of encrypt_field, values without the "enc:" prefix are returned as they are
+// ============================================================================================================================
+func decrypt_field(key []byte, marbleId string, field string, value string) (string, error) {
+	if !strings.HasPrefix(value, "enc:") {
+		return value, nil
+	}
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(value, "enc:"))
+	if err != nil {
+		return "", err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return "", err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return "", errors.New("encrypted " + field + " is too short")
+	}
+	plaintext, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], field_aad(marbleId, field))
+	if err != nil {
+		return "", errors.New("Failed to decrypt " + field)
+	}
+	return string(plaintext), nil
+}
+
+// ============================================================================================================================
+// Encrypt Marble - encrypt contact, balance and comments of a new marble with the transient key
+// ============================================================================================================================
+func encrypt_marble(stub shim.ChaincodeStubInterface, marble *Marble, key []byte) error {
+	var err error
+	marble.Contact, err = encrypt_field(stub, key, marble.Id, "contact", "contact", marble.Contact)
+	if err != nil {
+		return err
+	}
+	marble.BalanceEnc, err = encrypt_field(stub, key, marble.Id, "balance", "balance", strconv.Itoa(marble.Balance))
+	if err != nil {
+		return err
+	}
+	marble.Balance = 0
+	for step := range marble.Check {
+		if marble.Check[step].Comment == "" {
+			continue
+		}
+		marble.Check[step].Comment, err = encrypt_field(stub, key, marble.Id, "comment."+strconv.Itoa(step), "comment", marble.Check[step].Comment)
+		if err != nil {
+			return err
+		}
+	}
+	marble.Encrypted = true
+	marble.KeyId = key_id(key)
+	return nil
+}
+
+// ============================================================================================================================
+// Seal Comment - encrypt a review comment when the marble is encrypted, needs the marble's key
+// ============================================================================================================================
+func seal_comment(stub shim.ChaincodeStubInterface, marble Marble, comment string) (string, error) {
+	if !marble.Encrypted || comment == "" {
+		return comment, nil
+	}
+	key, err := get_marble_key_for(stub, marble)
+	if err != nil {
+		return comment, err
+	}
+	return encrypt_field(stub, key, marble.Id, "comment", "comment", comment)
+}
+
+// ============================================================================================================================
+// Encrypted Balance - decrypt the balance of an encrypted marble, needs the marble's key
+// ============================================================================================================================
+func encrypted_balance(stub shim.ChaincodeStubInterface, marble Marble) (int, error) {
+	key, err := get_marble_key_for(stub, marble)
+	if err != nil {
+		return 0, err
+	}
+	balance, err := decrypt_field(key, marble.Id, "balance", marble.BalanceEnc)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(balance)
+}
+
+// ============================================================================================================================
+// Open Marble - decrypt an encrypted marble for a query when the caller passed its key
+//
+// Marbles encrypted with another key, or queries without a key, are returned as stored.
+// ============================================================================================================================
+func open_marble(stub shim.ChaincodeStubInterface, marble *Marble) error {
+	if !marble.Encrypted {
+		return nil
+	}
+	key, ok, err := get_marble_key(stub)
+	if err != nil || !ok || key_id(key) != marble.KeyId {
+		return err
+	}
+
+	marble.Contact, err = decrypt_field(key, marble.Id, "contact", marble.Contact)
+	if err != nil {
+		return err
+	}
+	balance, err := decrypt_field(key, marble.Id, "balance", marble.BalanceEnc)
+	if err != nil {
+		return err
+	}
+	marble.Balance, err = strconv.Atoi(balance)
+	if err != nil {
+		return err
+	}
+	for step := range marble.Check {
+		marble.Check[step].Comment, err = decrypt_field(key, marble.Id, "comment", marble.Check[step].Comment)
+		if err != nil {
+			return err
+		}
+		for i := range marble.Check[step].Signatures {
+			marble.Check[step].Signatures[i].Comment, err = decrypt_field(key, marble.Id, "comment", marble.Check[step].Signatures[i].Comment)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// decrypt every marble of a query result the caller passed the key for
+func open_marbles(stub shim.ChaincodeStubInterface, marbles []Marble) error {
+	for i := range marbles {
+		err := open_marble(stub, &marbles[i])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
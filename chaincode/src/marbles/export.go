@@ -0,0 +1,210 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// ----- Export Row ----- //     one stage of one marble, flattened for spreadsheets
+//
+// The json tags are the column names, in column order. Columns are only ever added at the end.
+type ExportRow struct{
+	MarbleId       string `json:"marble_id"`
+	Product        string `json:"product"`
+	Created        string `json:"created"`           //date of the first stage of the route
+	Contact        string `json:"contact"`
+	Title          string `json:"title"`
+	Balance        string `json:"balance"`           //empty when it cannot be read (encrypted, no key)
+	Currency       string `json:"currency"`
+	LoanCurrency   string `json:"loan_currency"`
+	DueDate        string `json:"due_date"`
+	Status         string `json:"status"`
+	Summary        string `json:"summary"`           //e.g. "waiting BankCheck", see marble_summary
+	HolderId       string `json:"holder_id"`
+	HolderName     string `json:"holder_name"`
+	HolderCompany  string `json:"holder_company"`
+	CoreEnterprise string `json:"core_enterprise_id"`
+	Parent         string `json:"parent"`
+	Stage          int    `json:"stage"`
+	StageName      string `json:"stage_name"`
+	Review         string `json:"review"`            //disable, wait, success or failure
+	UserId         string `json:"user_id"`
+	Company        string `json:"company"`
+	Date           string `json:"date"`
+	Comment        string `json:"comment"`
+	EnteredAt      string `json:"entered_at"`
+	Deadline       string `json:"deadline"`
+	Escalated      bool   `json:"escalated"`
+	Seq            int    `json:"seq"`
+	Hash           string `json:"hash"`
+}
+
+var Export_columns = []string{
+	"marble_id", "product", "created", "contact", "title", "balance", "currency", "loan_currency", "due_date",
+	"status", "summary", "holder_id", "holder_name", "holder_company", "core_enterprise_id", "parent",
+	"stage", "stage_name", "review", "user_id", "company", "date", "comment", "entered_at", "deadline", "escalated",
+	"seq", "hash",
+}
+
+// the row as a CSV record, in the order of Export_columns
+func (row ExportRow) record() []string {
+	return []string{
+		row.MarbleId, row.Product, row.Created, row.Contact, row.Title, row.Balance, row.Currency, row.LoanCurrency,
+		row.DueDate, row.Status, row.Summary, row.HolderId, row.HolderName, row.HolderCompany, row.CoreEnterprise,
+		row.Parent, strconv.Itoa(row.Stage), row.StageName, row.Review, row.UserId, row.Company, row.Date,
+		row.Comment, row.EnteredAt, row.Deadline, strconv.FormatBool(row.Escalated), strconv.Itoa(row.Seq), row.Hash,
+	}
+}
+
+// one row per stage of a marble, stages in index order
+func export_rows(marble Marble, balance string) []ExportRow {
+	var rows []ExportRow
+	for step, check := range marble.Check {
+		row := ExportRow{MarbleId: marble.Id, Product: marble_product(marble), Contact: marble.Contact, Title: marble.Title}
+		row.Created = marble.Check[base_route(marble)[0]].Date
+		row.Balance = balance
+		row.Currency = marble.Currency
+		row.LoanCurrency = marble.LoanCurrency
+		row.DueDate = marble.DueDate
+		row.Status = marble.Status
+		row.Summary = marble_summary(marble)
+		row.HolderId = marble.User.Id
+		row.HolderName = marble.User.Username
+		row.HolderCompany = marble.User.Company
+		row.CoreEnterprise = marble.Check[CompanyCheck].UserID
+		row.Parent = marble.Parent
+		row.Stage = step
+		row.StageName = Step_name[step]
+		if check.Review >= 0 && check.Review < len(Review_name) {
+			row.Review = Review_name[check.Review]
+		}
+		row.UserId = check.UserID
+		row.Company = check.Company
+		row.Date = check.Date
+		row.Comment = check.Comment
+		row.EnteredAt = check.EnteredAt
+		row.Deadline = check.Deadline
+		row.Escalated = check.Escalated
+		row.Seq = check.Seq
+		row.Hash = check.Hash
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+// ============================================================================================================================
+// Export Marbles - every marble and its review trail as CSV or JSON Lines, one row per marble and stage
+//
+// A marble is exported when it was created between from and to (whole days when no time is given) and the company
+// takes part in it. The company is the invoker's, as for get_portfolio_stats; only the auditor may pass another one,
+// or leave it out to export every marble. Rows are in marble id order, then stage order. The CSV starts with a
+// header of Export_columns, the JSON Lines objects have the same keys in the same order. Encrypted marbles are
+// decrypted when their key is in the transient map, as for read. Query responses are limited in size by the peer,
+// export large ledgers a date range at a time.
+//
+// Inputs - Array of strings
+//       0        ,      1       ,      2       ,        3
+//    format      ,     from     ,      to      , company (optional)
+//  "csv"/"jsonl" , "2018-01-01" , "2018-03-31" ,   "bank"
+// ============================================================================================================================
+func export_marbles(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 3 && len(args) != 4 {
+		return shim.Error("Incorrect number of arguments. Expecting 3 or 4")
+	}
+	format := args[0]
+	if format != "csv" && format != "jsonl" {
+		return shim.Error("format must be csv or jsonl")
+	}
+	from, err := parse_date(args[1], false)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	to, err := parse_date(args[2], true)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	company := ""
+	if len(args) == 4 || !is_auditor_invoker(stub) {
+		company, err = report_company(stub, args[3:])
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	var buffer bytes.Buffer
+	writer := csv.NewWriter(&buffer)
+	if format == "csv" {
+		writer.Write(Export_columns)
+	}
+
+	ids, err := get_marble_ids(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	for _, id := range ids {
+		marbleAsBytes, err := stub.GetState(id)
+		if err != nil {
+			return shim.Error("Failed to get marble - " + id)
+		}
+		if len(marbleAsBytes) == 0 {
+			continue                                           //deleted
+		}
+		var marble Marble
+		json.Unmarshal(marbleAsBytes, &marble)
+		created := marble.Check[base_route(marble)[0]].Date
+		if created < from.Format(DateLayout) || created > to.Format(DateLayout) {
+			continue
+		}
+		if company != "" && !stat_companies(marble)[company] {
+			continue
+		}
+
+		balance := ""
+		if amount, err := marble_balance(stub, marble); err == nil {
+			balance = strconv.Itoa(amount)
+		}
+		err = open_marble(stub, &marble)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		for _, row := range export_rows(marble, balance) {
+			if format == "csv" {
+				writer.Write(row.record())
+				continue
+			}
+			rowAsBytes, _ := json.Marshal(row)
+			buffer.Write(rowAsBytes)
+			buffer.WriteString("\n")
+		}
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(buffer.Bytes())
+}
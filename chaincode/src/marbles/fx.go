@@ -0,0 +1,342 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// ============================================================================================================================
+// FX - marbles whose loan currency differs from the currency of the receivable
+//
+// A user of RatePublisherCompany publishes rates under "fx~pair~effective", one key per pair and effective time, never
+// overwritten. When a bank stage (BankCheck, BankRecv) succeeds on a marble with two currencies, the balance is
+// converted at the rate of the pair (or the inverse pair) that is effective at the transaction timestamp, rounded
+// down, and a snapshot of that rate is kept in marble.Fx. Rates cannot be backdated, so a conversion once made can
+// always be found again on the ledger.
+// ============================================================================================================================
+
+// a currency code, three upper case letters
+func check_currency(code string) error {
+	if len(code) != 3 || strings.ToUpper(code) != code || strings.Trim(code, "ABCDEFGHIJKLMNOPQRSTUVWXYZ") != "" {
+		return errors.New("currency must be a 3 letter code like USD, got '" + code + "'")
+	}
+	return nil
+}
+
+// "USD/CNY" to USD and CNY
+func parse_pair(pair string) (string, string, error) {
+	parts := strings.Split(pair, "/")
+	if len(parts) != 2 || check_currency(parts[0]) != nil || check_currency(parts[1]) != nil || parts[0] == parts[1] {
+		return "", "", errors.New("pair must be like USD/CNY, got '" + pair + "'")
+	}
+	return parts[0], parts[1], nil
+}
+
+// does the marble need converting between two currencies
+func is_cross_currency(marble Marble) bool {
+	return marble.Currency != "" && marble.LoanCurrency != "" && marble.Currency != marble.LoanCurrency
+}
+
+// ============================================================================================================================
+// Get FX Rate - the latest rate of a pair effective at date, and its key
+// ============================================================================================================================
+func get_fx_rate(stub shim.ChaincodeStubInterface, base string, quote string, date string) (FxRate, string, error) {
+	var rate FxRate
+	key := ""
+	resultsIterator, err := stub.GetStateByPartialCompositeKey("fx", []string{base + "/" + quote})
+	if err != nil {
+		return rate, key, err
+	}
+	defer resultsIterator.Close()
+
+	for resultsIterator.HasNext() {
+		aKeyValue, err := resultsIterator.Next()
+		if err != nil {
+			return rate, key, err
+		}
+		var candidate FxRate
+		json.Unmarshal(aKeyValue.Value, &candidate)
+		if candidate.Effective <= date && candidate.Effective > rate.Effective {
+			rate = candidate
+			key = aKeyValue.Key
+		}
+	}
+	if key == "" {
+		return rate, key, errors.New("no " + base + "/" + quote + " rate is effective at " + date)
+	}
+	return rate, key, nil
+}
+
+// ============================================================================================================================
+// Convert Amount - amount in from to the to currency at the rate effective at date, with the snapshot of that rate
+//
+// Uses the from/to rate when there is one, else divides by the to/from rate. Rounds down.
+// ============================================================================================================================
+func convert_amount(stub shim.ChaincodeStubInterface, amount int, from string, to string, date string) (int, FxSnapshot, error) {
+	var snapshot FxSnapshot
+	rate, key, err := get_fx_rate(stub, from, to, date)
+	if err != nil {
+		rate, key, err = get_fx_rate(stub, to, from, date)
+		if err != nil {
+			return 0, snapshot, errors.New("no " + from + "/" + to + " rate, nor its inverse, is effective at " + date)
+		}
+		snapshot.Inverse = true
+	}
+	snapshot.Key = key
+	snapshot.Base = rate.Base
+	snapshot.Quote = rate.Quote
+	snapshot.RateMicros = rate.RateMicros
+	snapshot.Effective = rate.Effective
+	snapshot.Publisher = rate.Publisher
+	converted, err := apply_fx(amount, snapshot)
+	return converted, snapshot, err
+}
+
+// convert with a snapshot, the same way whenever it is applied again
+func apply_fx(amount int, snapshot FxSnapshot) (int, error) {
+	converted := new(big.Int)
+	if snapshot.Inverse {
+		converted.Mul(big.NewInt(int64(amount)), big.NewInt(1000000))
+		converted.Quo(converted, big.NewInt(snapshot.RateMicros))
+	} else {
+		converted.Mul(big.NewInt(int64(amount)), big.NewInt(snapshot.RateMicros))
+		converted.Quo(converted, big.NewInt(1000000))
+	}
+	if !converted.IsInt64() {
+		return 0, errors.New("converting " + strconv.Itoa(amount) + " at the " + snapshot.Base + "/" + snapshot.Quote + " rate overflows")
+	}
+	return int(converted.Int64()), nil
+}
+
+// the snapshot taken when step succeeded, nil when there was no conversion
+func fx_snapshot(marble Marble, step int) *FxSnapshot {
+	for i := len(marble.Fx) - 1; i >= 0; i-- {
+		if marble.Fx[i].Step == step {
+			return &marble.Fx[i]
+		}
+	}
+	return nil
+}
+
+// ============================================================================================================================
+// FX Stage - called by review_one when a bank stage succeeds, records the rate the financing or repayment used
+//
+// The amounts are left out of the snapshot for private and encrypted marbles, loan_amount works them out again.
+// ============================================================================================================================
+func fx_stage(stub shim.ChaincodeStubInterface, marble *Marble, step int) error {
+	if !is_cross_currency(*marble) || (step != BankCheck && step != BankRecv) {
+		return nil
+	}
+	balance, err := marble_balance(stub, *marble)
+	if err != nil {
+		return err
+	}
+	converted, snapshot, err := convert_amount(stub, balance, marble.Currency, marble.LoanCurrency, marble.Check[step].Date)
+	if err != nil {
+		return err
+	}
+	snapshot.Step = step
+	snapshot.Date = marble.Check[step].Date
+	if marble.PrivateHash == "" && !marble.Encrypted {
+		snapshot.Amount = balance
+		snapshot.Converted = converted
+	}
+	marble.Fx = append(marble.Fx, snapshot)
+	return nil
+}
+
+// the balance in the loan currency, at the rate recorded when step succeeded
+func loan_amount(stub shim.ChaincodeStubInterface, marble Marble, step int) (int, error) {
+	balance, err := marble_balance(stub, marble)
+	if err != nil {
+		return 0, err
+	}
+	snapshot := fx_snapshot(marble, step)
+	if !is_cross_currency(marble) || snapshot == nil {
+		return balance, nil
+	}
+	return apply_fx(balance, *snapshot)
+}
+
+// ============================================================================================================================
+// Publish FX Rate - a rate publisher adds the rate of a pair from an effective time on
+//
+// Inputs - Array of strings
+//        0      ,     1    ,       2       ,        3
+//  publisher id ,   pair   ,  rate_micros  ,  effective (optional, the transaction time when left out)
+//    "o7777"    , "USD/CNY",   "6852300"   , "2018-07-01 00:00:00"        (1 USD = 6.8523 CNY)
+// ============================================================================================================================
+func publish_fx_rate(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	fmt.Println("starting publish_fx_rate")
+
+	if len(args) != 3 && len(args) != 4 {
+		return shim.Error("Incorrect number of arguments. Expecting 3 or 4")
+	}
+	err := sanitize_arguments(args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	publisher, err := get_user(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if !publisher.Enabled || publisher.Company != RatePublisherCompany {
+		return shim.Error("only a '" + RatePublisherCompany + "' user can publish rates")
+	}
+	base, quote, err := parse_pair(args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	rateMicros, err := strconv.ParseInt(args[2], 10, 64)
+	if err != nil || rateMicros <= 0 {
+		return shim.Error("3rd argument must be a positive rate in millionths")
+	}
+	now, err := get_tx_time(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	effective := now
+	if len(args) == 4 {
+		effective, err = parse_date(args[3], false)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if effective.Before(now) {
+			return shim.Error("rates cannot be backdated, " + args[3] + " is before the transaction time")
+		}
+	}
+
+	rate := FxRate{ObjectType: "fx_rate", Base: base, Quote: quote, RateMicros: rateMicros}
+	rate.Effective = effective.Format(DateLayout)
+	rate.Publisher = publisher.Id
+	rate.PublishedAt = now.Format(DateLayout)
+	key, err := stub.CreateCompositeKey("fx", []string{base + "/" + quote, rate.Effective})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	existing, err := stub.GetState(key)
+	if err != nil {
+		return shim.Error("Failed to get state for " + key)
+	}
+	if existing != nil {
+		return shim.Error("a " + args[1] + " rate is already effective at " + rate.Effective)
+	}
+	rateAsBytes, _ := json.Marshal(rate)
+	err = stub.PutState(key, rateAsBytes)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	fmt.Println("- end publish_fx_rate")
+	return shim.Success(rateAsBytes)
+}
+
+// ============================================================================================================================
+// Read FX Rate - the rate of a pair effective at a time
+//
+// Inputs - Array of strings
+//       0    ,          1
+//     pair   ,  at (optional, the transaction time when left out)
+//  "USD/CNY" , "2018-07-15"
+// ============================================================================================================================
+func read_fx_rate(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 && len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 1 or 2")
+	}
+	base, quote, err := parse_pair(args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	at, err := get_tx_time(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if len(args) == 2 {
+		at, err = parse_date(args[1], true)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+	rate, _, err := get_fx_rate(stub, base, quote, at.Format(DateLayout))
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	rateAsBytes, _ := json.Marshal(rate)
+	return shim.Success(rateAsBytes)
+}
+
+// ============================================================================================================================
+// Set Currency - the currency of the receivable and the one it is financed in, until the bank finances it
+//
+// Inputs - Array of strings
+//        0      ,          1           ,     2     ,       3
+//    marble id  , holder or bank id    , currency  , loan currency
+//  "m999999999" ,      "o1111"         ,   "USD"   ,     "CNY"
+// ============================================================================================================================
+func set_currency(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	fmt.Println("starting set_currency")
+
+	if len(args) != 4 {
+		return shim.Error("Incorrect number of arguments. Expecting 4")
+	}
+	err := sanitize_arguments(args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	marble, err := get_marble(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = check_marble_active(marble)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	user, err := get_user(stub, args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if !user.Enabled || (user.Id != marble.User.Id && user.Company != Step_company[BankCheck]) {
+		return shim.Error("only the supplier holding the marble or the bank can set its currencies")
+	}
+	if marble.Check[EndOf].Review != Disable || marble.Check[BankCheck].Review == Success {
+		return shim.Error("marble " + marble.Id + " is already financed or closed")
+	}
+	if check_currency(args[2]) != nil || check_currency(args[3]) != nil {
+		return shim.Error("currencies must be 3 letter codes like USD")
+	}
+	marble.Currency = args[2]
+	marble.LoanCurrency = args[3]
+
+	jsonAsBytes, err := put_marble(stub, marble)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	fmt.Println("- end set_currency")
+	return shim.Success(jsonAsBytes)
+}
@@ -0,0 +1,55 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestApplyFx(t *testing.T) {
+	usdCny := FxSnapshot{Base: "USD", Quote: "CNY", RateMicros: 6852300}
+	inverse := usdCny
+	inverse.Inverse = true
+	tests := []struct {
+		name      string
+		amount    int
+		snapshot  FxSnapshot
+		converted int
+		ok        bool
+	}{
+		{"base to quote", 1000, usdCny, 6852, true}, //6852.3 rounded down
+		{"quote to base", 6852, inverse, 999, true}, //999.96 rounded down
+		{"one to one", 500, FxSnapshot{RateMicros: 1000000}, 500, true},
+		{"rounds to nothing", 1, FxSnapshot{RateMicros: 1}, 0, true},
+		{"large amount", math.MaxInt64 / 10, FxSnapshot{RateMicros: 5000000}, math.MaxInt64 / 10 * 5, true},
+		{"overflow", math.MaxInt64 / 2, usdCny, 0, false},
+		{"overflow inverse", math.MaxInt64 / 2, FxSnapshot{RateMicros: 1, Inverse: true}, 0, false},
+	}
+	for _, test := range tests {
+		converted, err := apply_fx(test.amount, test.snapshot)
+		if (err == nil) != test.ok {
+			t.Errorf("%s: got error %v, want ok %v", test.name, err, test.ok)
+		}
+		if converted != test.converted {
+			t.Errorf("%s: converted to %d, want %d", test.name, converted, test.converted)
+		}
+	}
+}
@@ -20,12 +20,20 @@ under the License.
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"strconv"
+	"strings"
+	"time"
 
+	"github.com/golang/protobuf/ptypes"
+	"github.com/hyperledger/fabric/core/chaincode/lib/cid"
 	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/core/chaincode/shim/ext/statebased"
 	"fmt"
+	"sort"
 )
 
 // ============================================================================================================================
@@ -191,8 +199,1070 @@ func getUserByCompany(stub shim.ChaincodeStubInterface,company string)(user User
 		fmt.Println("on marble id - ", queryKeyAsStr)
 		json.Unmarshal(queryValAsBytes, &user) //un stringify it aka JSON.parse()
 		if user.Company == company{
+			return user,nil
+		}
+	}
+	return User{},errors.New("there is no user of company " + company)
+}
+
+// the user a stage of the marble waits for: the supplier holding it for the supplier's own stages (New, SuppRecv,
+// SuppRepayment), otherwise a user of the company owning the stage
+func getStageUser(stub shim.ChaincodeStubInterface, marble Marble, step int) (User, error) {
+	if Step_company[step] == Step_company[New] && marble.User.Id != "" {
+		return User{Id: marble.User.Id, Username: marble.User.Username, Company: marble.User.Company}, nil
+	}
+	return getUserByCompany(stub, Step_company[step])
+}
+
+// ============================================================================================================================
+// Get Quorum Rules - get all N-of-M approval rules from ledger
+// ============================================================================================================================
+func get_quorum_rules(stub shim.ChaincodeStubInterface) ([]QuorumRule, error) {
+	var rules []QuorumRule
+	rulesAsBytes, err := stub.GetState("quorum_rules")
+	if err != nil {
+		return rules, errors.New("Failed to get quorum rules")
+	}
+	if len(rulesAsBytes) == 0 {                              //no rule yet, every stage has a single reviewer
+		return rules, nil
+	}
+	err = json.Unmarshal(rulesAsBytes, &rules)
+	return rules, err
+}
+
+// ============================================================================================================================
+// Get Tx Time - the transaction timestamp, identical on every endorsing peer (unlike time.Now())
+// ============================================================================================================================
+func get_tx_time(stub shim.ChaincodeStubInterface) (time.Time, error) {
+	ts, err := stub.GetTxTimestamp()
+	if err != nil {
+		return time.Time{}, errors.New("Failed to get the transaction timestamp")
+	}
+	t, err := ptypes.Timestamp(ts)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return t.UTC(), nil
+}
+
+// the transaction timestamp formatted with DateLayout
+func get_tx_date(stub shim.ChaincodeStubInterface) (string, error) {
+	t, err := get_tx_time(stub)
+	if err != nil {
+		return "", err
+	}
+	return t.Format(DateLayout), nil
+}
+
+// ============================================================================================================================
+// Get Workflow - get the workflow definition, stages without a stored entry have no deadline
+// ============================================================================================================================
+func get_workflow(stub shim.ChaincodeStubInterface) (Workflow, error) {
+	var workflow Workflow
+	workflowAsBytes, err := stub.GetState("workflow")
+	if err != nil {
+		return workflow, errors.New("Failed to get workflow")
+	}
+	if len(workflowAsBytes) > 0 {
+		err = json.Unmarshal(workflowAsBytes, &workflow)
+		if err != nil {
+			return workflow, err
+		}
+	}
+
+	//one entry per stage, names and companies always come from Step_name/Step_company
+	var stages []StageDef
+	for step := 0; step < StepNum; step++ {
+		var def StageDef
+		for _, stored := range workflow.Stages {
+			if stored.Step == step {
+				def = stored
+			}
+		}
+		def.Step = step
+		def.Name = Step_name[step]
+		def.Company = Step_company[step]
+		stages = append(stages, def)
+	}
+	workflow.ObjectType = "workflow"
+	workflow.Stages = stages
+	workflow.DefaultRoute = Default_route
+	workflow.ProductRoutes = map[string][]int{Receivable: Default_route, Reverse: Reverse_route}
+	return workflow, nil
+}
+
+// ============================================================================================================================
+// Enter Stage - make a marble wait for a stage
+//
+// Records who has to act and since when, computes the deadline from the stage SLA and applies the quorum rule.
+// ============================================================================================================================
+func enter_stage(stub shim.ChaincodeStubInterface, marble *Marble, step int, userID string, company string, date string) error {
+	marble.Check[step].UserID = userID
+	marble.Check[step].Company = company
+	marble.Check[step].Review = Wait
+	marble.Check[step].EnteredAt = date
+	marble.Check[step].Deadline = ""
+	marble.Check[step].Escalated = false
+
+	workflow, err := get_workflow(stub)
+	if err != nil {
+		return err
+	}
+	if hours := workflow.Stages[step].SlaHours; hours > 0 {
+		entered, err := time.Parse(DateLayout, date)
+		if err != nil {
+			return err
+		}
+		marble.Check[step].Deadline = entered.Add(time.Duration(hours) * time.Hour).Format(DateLayout)
+	}
+
+	return apply_quorum_rule(stub, marble, step)
+}
+
+// ============================================================================================================================
+// End Marble - close the marble with Success or Failure
+// ============================================================================================================================
+func end_marble(marble *Marble, review int, userID string, company string, comment string, date string) {
+	marble.Check[EndOf].Review = review
+	marble.Check[EndOf].UserID = userID
+	marble.Check[EndOf].Company = company
+	marble.Check[EndOf].Comment = comment
+	marble.Check[EndOf].Date = date
+}
+
+// ============================================================================================================================
+// Apply Quorum Rule - set the reviewer set of a stage the marble has just entered
+//
+// The rule of this step with the highest min_balance that is <= the marble balance decides the quorum.
+// Without a matching rule the stage keeps its single reviewer (Check[step].UserID).
+// ============================================================================================================================
+func apply_quorum_rule(stub shim.ChaincodeStubInterface, marble *Marble, step int) error {
+	rules, err := get_quorum_rules(stub)
+	if err != nil {
+		return err
+	}
+	balance, err := marble_balance(stub, *marble)
+	if err != nil {
+		return err
+	}
+
+	found := -1
+	for i := 0; i < len(rules); i++ {
+		if rules[i].Step != step || rules[i].MinBalance > balance {
+			continue
+		}
+		if found < 0 || rules[i].MinBalance > rules[found].MinBalance {
+			found = i
+		}
+	}
+
+	marble.Check[step].Signatures = nil
+	if found < 0 {
+		marble.Check[step].Reviewers = nil
+		marble.Check[step].Quorum = 0
+		return nil
+	}
+	marble.Check[step].Reviewers = rules[found].Reviewers
+	marble.Check[step].Quorum = rules[found].Quorum
+	return nil
+}
+
+// ============================================================================================================================
+// Sign Stage - record one reviewer's decision in a quorum stage
+//
+// Returns the resulting review of the stage: Wait while more signatures are needed, Success once quorum approvals
+// are collected, Failure once the remaining reviewers can no longer reach the quorum.
+// ============================================================================================================================
+func sign_stage(marble *Marble, step int, user User, state int, comment string, date string) (int, error) {
+	check := &marble.Check[step]
+
+	isReviewer := false
+	for _, id := range check.Reviewers {
+		if id == user.Id {
+			isReviewer = true
 			break
 		}
 	}
-	return user,nil
+	if !isReviewer {
+		return Wait, errors.New("user :" + user.Id + " is not a reviewer of this stage")
+	}
+	for _, sig := range check.Signatures {
+		if sig.UserID == user.Id {
+			return Wait, errors.New("user :" + user.Id + " has already signed this stage")
+		}
+	}
+	if state != Success && state != Failure {
+		return Wait, errors.New("the marbles state is wrong")
+	}
+
+	var sig Signature
+	sig.UserID = user.Id
+	sig.Company = user.Company
+	sig.Date = date
+	sig.Review = state
+	sig.Comment = comment
+	check.Signatures = append(check.Signatures, sig)
+
+	approvals := 0
+	rejections := 0
+	for _, s := range check.Signatures {
+		if s.Review == Success {
+			approvals++
+		} else {
+			rejections++
+		}
+	}
+	if approvals >= check.Quorum {
+		return Success, nil
+	}
+	if len(check.Reviewers)-rejections < check.Quorum {
+		return Failure, nil
+	}
+	return Wait, nil
+}
+
+// ============================================================================================================================
+// Get Routing Rules - get all amount based routing rules from ledger
+// ============================================================================================================================
+func get_routing_rules(stub shim.ChaincodeStubInterface) ([]RoutingRule, error) {
+	var rules []RoutingRule
+	rulesAsBytes, err := stub.GetState("routing_rules")
+	if err != nil {
+		return rules, errors.New("Failed to get routing rules")
+	}
+	if len(rulesAsBytes) == 0 {                              //no rule yet, every marble follows Default_route
+		return rules, nil
+	}
+	err = json.Unmarshal(rulesAsBytes, &rules)
+	return rules, err
+}
+
+// test if the balance is inside the rule's [min_balance, max_balance) window
+func rule_matches(rule RoutingRule, balance int) bool {
+	if balance < rule.MinBalance {
+		return false
+	}
+	if rule.MaxBalance > 0 && balance >= rule.MaxBalance {
+		return false
+	}
+	return true
+}
+
+// ============================================================================================================================
+// Compute Route - apply the routing rules, in stored order, to the base route of the product (Default_route)
+//
+// Returns the resulting stage order and the ids of the rules that changed it.
+// ============================================================================================================================
+func compute_route(base []int, rules []RoutingRule, balance int) ([]int, []string) {
+	route := append([]int{}, base...)
+	var fired []string
+
+	for _, rule := range rules {
+		if !rule_matches(rule, balance) {
+			continue
+		}
+		pos := route_index(route, rule.Step)
+		if rule.Action == "skip" {
+			if pos < 0 {
+				continue
+			}
+			route = append(route[:pos], route[pos+1:]...)
+		} else if rule.Action == "add" {
+			after := route_index(route, rule.After)
+			if pos >= 0 || after < 0 {
+				continue
+			}
+			route = append(route[:after+1], append([]int{rule.Step}, route[after+1:]...)...)
+		} else {
+			continue
+		}
+		fired = append(fired, rule.Id)
+	}
+	return route, fired
+}
+
+// position of a stage in a route, -1 if the route does not pass it
+func route_index(route []int, step int) int {
+	for i, s := range route {
+		if s == step {
+			return i
+		}
+	}
+	return -1
+}
+
+// the stage following step on the route, -1 if step is not on the route
+func next_stage(route []int, step int) int {
+	pos := route_index(route, step)
+	if pos < 0 || pos+1 >= len(route) {
+		return -1
+	}
+	return route[pos+1]
+}
+
+// ============================================================================================================================
+// Route Marble - re-evaluate the routing rules for a marble and return the stage after step
+//
+// Rules are evaluated again on every transition, so the stages still ahead follow the current rules and balance.
+// If step is no longer on the new route the marble keeps the route it was on.
+// ============================================================================================================================
+func route_marble(stub shim.ChaincodeStubInterface, marble *Marble, step int) (int, error) {
+	rules, err := get_routing_rules(stub)
+	if err != nil {
+		return -1, err
+	}
+
+	balance, err := marble_balance(stub, *marble)
+	if err != nil {
+		return -1, err
+	}
+
+	route, fired := compute_route(base_route(*marble), rules, balance)
+	next := next_stage(route, step)
+	if next < 0 {
+		route = marble.Route
+		if len(route) == 0 {
+			route = base_route(*marble)
+		}
+		next = next_stage(route, step)
+		if next < 0 {
+			return -1, errors.New("stage " + strconv.Itoa(step) + " is not on the route of marble " + marble.Id)
+		}
+	} else {
+		marble.Route = route
+		marble.Rules = fired
+	}
+	return next, nil
+}
+
+// test if the step is a stage somebody reviews, i.e. not New and not EndOf
+func is_review_step(step int) bool {
+	return step > New && step < StepNum && step != EndOf
+}
+
+// ============================================================================================================================
+// Get Escalation Chain - get the supervisors of a company, an empty chain if none was set
+// ============================================================================================================================
+func get_escalation_chain(stub shim.ChaincodeStubInterface, company string) (EscalationChain, error) {
+	var chain EscalationChain
+	chainAsBytes, err := stub.GetState("escalation_" + company)
+	if err != nil {
+		return chain, errors.New("Failed to get escalation chain - " + company)
+	}
+	if len(chainAsBytes) > 0 {
+		err = json.Unmarshal(chainAsBytes, &chain)
+	}
+	chain.Company = company
+	return chain, err
+}
+
+// ============================================================================================================================
+// Reassign Stage - hand a pending stage to the next supervisor of the escalation chain
+//
+// Every reassignment moves one level up the chain. In a quorum stage the supervisor takes the seat of the first
+// reviewer who has not signed yet.
+// ============================================================================================================================
+func reassign_stage(marble *Marble, step int, chain EscalationChain, date string, reason string) (Reassignment, error) {
+	var re Reassignment
+	check := &marble.Check[step]
+
+	level := len(check.Reassignments)
+	if level >= len(chain.Supervisors) {
+		return re, errors.New("no supervisor left to escalate step " + Step_name[step] + " of marble " + marble.Id)
+	}
+	re.To = chain.Supervisors[level]
+	re.Date = date
+	re.Reason = reason
+
+	if len(check.Reviewers) == 0 {
+		re.From = check.UserID
+		check.UserID = re.To
+	} else {
+		for _, id := range check.Reviewers {
+			if id == re.To {
+				return re, errors.New("supervisor " + re.To + " already reviews step " + Step_name[step])
+			}
+		}
+		signed := map[string]bool{}
+		for _, sig := range check.Signatures {
+			signed[sig.UserID] = true
+		}
+		for i, id := range check.Reviewers {
+			if !signed[id] {
+				re.From = id
+				check.Reviewers = append(append([]string{}, check.Reviewers[:i]...), append([]string{re.To}, check.Reviewers[i+1:]...)...)
+				break
+			}
+		}
+	}
+
+	check.Escalated = true
+	check.Reassignments = append(check.Reassignments, re)
+	return re, nil
+}
+
+// ============================================================================================================================
+// Check Marble Active - workflow transitions are only allowed on marbles that are not frozen by a dispute
+// ============================================================================================================================
+func check_marble_active(marble Marble) error {
+	if marble.Status == Disputed {
+		return errors.New("marble " + marble.Id + " is disputed, resolve the dispute first")
+	}
+	if marble.Status == Split {
+		return errors.New("marble " + marble.Id + " is fully split, work on its children")
+	}
+	return nil
+}
+
+// test if the user holds the marble or has been asked to act on it
+func is_participant(marble Marble, userID string) bool {
+	if marble.User.Id == userID {
+		return true
+	}
+	for _, check := range marble.Check {
+		if check.UserID == userID {
+			return true
+		}
+		for _, id := range check.Reviewers {
+			if id == userID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// test if s looks like a hex encoded sha256 digest
+func is_sha256_hex(s string) bool {
+	if len(s) != 64 {
+		return false
+	}
+	for _, c := range s {
+		if !(c >= '0' && c <= '9') && !(c >= 'a' && c <= 'f') && !(c >= 'A' && c <= 'F') {
+			return false
+		}
+	}
+	return true
+}
+
+// the stage a marble is waiting for, -1 if none
+func pending_step(marble Marble) int {
+	for i := 0; i < StepNum; i++ {
+		if i != EndOf && marble.Check[i].Review == Wait {
+			return i
+		}
+	}
+	return -1
+}
+
+// ============================================================================================================================
+// Get Private Input - the commercial terms passed in the transient map under "marble_private", if any
+//
+// Transient data is not recorded in the transaction, so amounts passed this way stay off the public ledger.
+// ============================================================================================================================
+func get_private_input(stub shim.ChaincodeStubInterface) (MarblePrivate, bool, error) {
+	var private MarblePrivate
+	transient, err := stub.GetTransient()
+	if err != nil {
+		return private, false, errors.New("Failed to get the transient map")
+	}
+	privateAsBytes, ok := transient["marble_private"]
+	if !ok {
+		return private, false, nil
+	}
+	err = json.Unmarshal(privateAsBytes, &private)
+	if err != nil {
+		return private, false, errors.New("transient marble_private must be a JSON object")
+	}
+	private.Salt = ""                                        //only taken from marble_salt, see put_marble_private
+	if private.Balance < 0 || private.InterestRate < 0 {
+		return private, false, errors.New("transient marble_private must not hold negative numbers")
+	}
+	return private, true, nil
+}
+
+// ============================================================================================================================
+// Get Marble Private - get the private commercial terms of a marble, only works on peers of the collection members
+// ============================================================================================================================
+func get_marble_private(stub shim.ChaincodeStubInterface, id string) (MarblePrivate, error) {
+	var private MarblePrivate
+	privateAsBytes, err := stub.GetPrivateData(PrivateCollection, id)
+	if err != nil {
+		return private, errors.New("Failed to get private data of marble - " + id)
+	}
+	json.Unmarshal(privateAsBytes, &private)
+	if private.Id != id {
+		return private, errors.New("private data of marble " + id + " is not available on this peer")
+	}
+	return private, nil
+}
+
+// ============================================================================================================================
+// Put Marble Private - store the commercial terms privately, the public marble keeps their hash and a zero balance
+//
+// The id and terms are small known values, so the record carries a random salt that goes into the hash. The client
+// passes it as at least 16 random bytes in the transient map under "marble_salt" when the terms are first stored;
+// later updates keep the salt of the record.
+// ============================================================================================================================
+func put_marble_private(stub shim.ChaincodeStubInterface, marble *Marble, private MarblePrivate) error {
+	private.ObjectType = "marble_private"
+	private.Id = marble.Id
+	if private.BankComments == nil {
+		private.BankComments = []BankComment{}
+	}
+	if private.Salt == "" {
+		transient, err := stub.GetTransient()
+		if err != nil {
+			return errors.New("Failed to get the transient map")
+		}
+		salt := transient["marble_salt"]
+		if len(salt) < 16 {
+			return errors.New("pass at least 16 random bytes as transient marble_salt to keep the private terms of " + marble.Id + " private")
+		}
+		private.Salt = hex.EncodeToString(salt)
+	}
+	privateAsBytes, _ := json.Marshal(private)
+	err := stub.PutPrivateData(PrivateCollection, marble.Id, privateAsBytes)
+	if err != nil {
+		return err
+	}
+	hash := sha256.Sum256(privateAsBytes)
+	marble.PrivateHash = hex.EncodeToString(hash[:])
+	marble.Balance = 0
+	return nil
+}
+
+// ============================================================================================================================
+// Marble Balance - the balance of a marble, read from the private collection when the terms are private and
+// decrypted with the transient key when the marble is encrypted
+// ============================================================================================================================
+func marble_balance(stub shim.ChaincodeStubInterface, marble Marble) (int, error) {
+	if marble.Encrypted {
+		return encrypted_balance(stub, marble)
+	}
+	if marble.PrivateHash == "" {
+		return marble.Balance, nil
+	}
+	private, err := get_marble_private(stub, marble.Id)
+	if err != nil {
+		return 0, err
+	}
+	return private.Balance, nil
+}
+
+// ============================================================================================================================
+// Keep Bank Comment - move a bank's review comment of a private marble into the private collection
+//
+// Returns the comment to store on the public marble, empty when it was kept privately.
+// ============================================================================================================================
+func keep_bank_comment(stub shim.ChaincodeStubInterface, marble *Marble, step int, user User, comment string, date string) (string, error) {
+	if marble.PrivateHash == "" || user.Company != Step_company[BankCheck] || comment == "" {
+		return comment, nil
+	}
+	private, err := get_marble_private(stub, marble.Id)
+	if err != nil {
+		return comment, err
+	}
+	private.BankComments = append(private.BankComments, BankComment{step, user.Id, date, comment})
+	err = put_marble_private(stub, marble, private)
+	if err != nil {
+		return comment, err
+	}
+	return "", nil
+}
+
+// ============================================================================================================================
+// Put Marble - store a marble and restrict who may endorse its next update
+// ============================================================================================================================
+func put_marble(stub shim.ChaincodeStubInterface, marble Marble) ([]byte, error) {
+	actor, err := get_actor(stub)
+	if err != nil {
+		return nil, err
+	}
+	marble.ModifiedBy = actor
+	seal_decisions(&marble)
+	err = index_marble(stub, marble.Id, &marble)
+	if err != nil {
+		return nil, err
+	}
+	jsonAsBytes, _ := json.Marshal(marble)                   //convert to array of bytes
+	err = stub.PutState(marble.Id, jsonAsBytes)
+	if err != nil {
+		return jsonAsBytes, err
+	}
+	registryKey, err := stub.CreateCompositeKey("marble~id", []string{marble.Id})  //stays when the marble is deleted
+	if err != nil {
+		return jsonAsBytes, err
+	}
+	err = stub.PutState(registryKey, []byte{0x00})
+	if err != nil {
+		return jsonAsBytes, err
+	}
+	err = set_marble_ep(stub, marble)
+	return jsonAsBytes, err
+}
+
+// ============================================================================================================================
+// Get Org MSPs - the MSP id of every company that registered one
+// ============================================================================================================================
+func get_org_msps(stub shim.ChaincodeStubInterface) (map[string]string, error) {
+	msps := map[string]string{}
+	mspsAsBytes, err := stub.GetState("org_msps")
+	if err != nil {
+		return msps, errors.New("Failed to get org msps")
+	}
+	if len(mspsAsBytes) > 0 {
+		err = json.Unmarshal(mspsAsBytes, &msps)
+	}
+	return msps, err
+}
+
+// ============================================================================================================================
+// Set Marble EP - key-level endorsement policy of a marble (needs Fabric 1.3 or later)
+//
+// An update of the marble must be endorsed by a peer of every organization involved in it: the supplier holding it,
+// the core enterprise, the bank and the owner of the step it waits for (e.g. the risk committee). Companies without a
+// registered MSP are left out; when none is registered the chaincode endorsement policy applies as before.
+// ============================================================================================================================
+func set_marble_ep(stub shim.ChaincodeStubInterface, marble Marble) error {
+	msps, err := get_org_msps(stub)
+	if err != nil {
+		return err
+	}
+
+	companies := []string{marble.User.Company, Step_company[CompanyCheck], Step_company[BankCheck]}
+	if step := pending_step(marble); step >= 0 {
+		companies = append(companies, Step_company[step])
+		if marble.Check[step].Company != "" {
+			companies = append(companies, marble.Check[step].Company)
+		}
+	}
+
+	seen := map[string]bool{}
+	var orgs []string
+	for _, company := range companies {
+		msp, ok := msps[company]
+		if !ok || seen[msp] {
+			continue
+		}
+		seen[msp] = true
+		orgs = append(orgs, msp)
+	}
+	if len(orgs) == 0 {
+		return nil
+	}
+	sort.Strings(orgs)
+
+	ep, err := statebased.NewStateEP(nil)
+	if err != nil {
+		return err
+	}
+	err = ep.AddOrgs(statebased.RoleTypePeer, orgs...)
+	if err != nil {
+		return err
+	}
+	policy, err := ep.Policy()
+	if err != nil {
+		return err
+	}
+	return stub.SetStateValidationParameter(marble.Id, policy)
+}
+
+// the MSP id of the organization that submitted the transaction
+func get_invoker_msp(stub shim.ChaincodeStubInterface) (string, error) {
+	msp, err := cid.GetMSPID(stub)
+	if err != nil {
+		return "", errors.New("Failed to get the MSP id of the invoker")
+	}
+	return msp, nil
+}
+
+// reject a call from any organization but the one that instantiated the chaincode (admin_msp, stored by Init)
+func check_admin_invoker(stub shim.ChaincodeStubInterface, action string) error {
+	invoker, err := get_invoker_msp(stub)
+	if err != nil {
+		return err
+	}
+	adminAsBytes, err := stub.GetState("admin_msp")
+	if err != nil {
+		return errors.New("Failed to get admin msp")
+	}
+	if len(adminAsBytes) == 0 || invoker != string(adminAsBytes) {
+		return errors.New("only the organization that instantiated the chaincode can " + action + ", not " + invoker)
+	}
+	return nil
+}
+
+// ============================================================================================================================
+// Check Not Auditor - reject a write done by, or on behalf of, the auditor
+//
+// The auditor is recognized by the "role" attribute of the invoker certificate, by the MSP registered for the auditor
+// company, or by an acting user argument (see Actor_arguments) naming the auditor company or one of its users.
+// ============================================================================================================================
+func check_not_auditor(stub shim.ChaincodeStubInterface, function string, args []string) error {
+	role, found, err := cid.GetAttributeValue(stub, "role")
+	if err == nil && found && role == AuditorCompany {
+		return errors.New("the auditor may not call " + function)
+	}
+
+	msps, err := get_org_msps(stub)
+	if err != nil {
+		return err
+	}
+	if msp, ok := msps[AuditorCompany]; ok {
+		invoker, err := cid.GetMSPID(stub)
+		if err == nil && invoker == msp {
+			return errors.New("the auditor organization may not call " + function)
+		}
+	}
+
+	for _, i := range Actor_arguments[function] {
+		if i >= len(args) {
+			continue
+		}
+		if args[i] == AuditorCompany {
+			return errors.New("the auditor may not call " + function)
+		}
+		userAsBytes, err := stub.GetState(args[i])
+		if err != nil || len(userAsBytes) == 0 {
+			continue
+		}
+		var user User
+		if json.Unmarshal(userAsBytes, &user) == nil && is_auditor(user) {
+			return errors.New("the auditor may not call " + function)
+		}
+	}
+	return nil
+}
+
+// is this user an auditor
+func is_auditor(user User) bool {
+	return user.Company == AuditorCompany && user.Id != ""
+}
+
+// parse a date argument, "2006-01-02 15:04:05" or a whole day "2006-01-02"
+func parse_date(s string, endOfDay bool) (time.Time, error) {
+	t, err := time.Parse(DateLayout, s)
+	if err == nil {
+		return t, nil
+	}
+	t, err = time.Parse("2006-01-02", s)
+	if err != nil {
+		return t, errors.New("date must be like " + DateLayout + " or 2006-01-02, got " + s)
+	}
+	if endOfDay {
+		t = t.Add(24*time.Hour - time.Second)
+	}
+	return t, nil
+}
+
+// the identity that submitted the transaction
+func get_actor(stub shim.ChaincodeStubInterface) (Actor, error) {
+	var actor Actor
+	msp, err := get_invoker_msp(stub)
+	if err != nil {
+		return actor, err
+	}
+	id, err := cid.GetID(stub)
+	if err != nil {
+		return actor, errors.New("Failed to get the id of the invoker")
+	}
+	actor.MSP = msp
+	actor.ID = id
+	return actor, nil
+}
+
+// ============================================================================================================================
+// Diff JSON - the fields that differ between two versions of a JSON document
+//
+// Nested objects and arrays are flattened to dotted paths, e.g. "check.2.review". A field missing on one side is null.
+// ============================================================================================================================
+func diff_json(oldAsBytes []byte, newAsBytes []byte, skip map[string]bool) []FieldChange {
+	oldFields := map[string]interface{}{}
+	newFields := map[string]interface{}{}
+	var oldValue, newValue interface{}
+	if len(oldAsBytes) > 0 && json.Unmarshal(oldAsBytes, &oldValue) == nil {
+		flatten_json("", oldValue, oldFields)
+	}
+	if len(newAsBytes) > 0 && json.Unmarshal(newAsBytes, &newValue) == nil {
+		flatten_json("", newValue, newFields)
+	}
+
+	var fields []string
+	for field := range oldFields {
+		fields = append(fields, field)
+	}
+	for field := range newFields {
+		if _, ok := oldFields[field]; !ok {
+			fields = append(fields, field)
+		}
+	}
+	sort.Strings(fields)
+
+	changes := []FieldChange{}
+	for _, field := range fields {
+		if skip[strings.SplitN(field, ".", 2)[0]] {
+			continue
+		}
+		oldField, newField := oldFields[field], newFields[field]
+		if oldField != newField {
+			changes = append(changes, FieldChange{Field: field, Old: oldField, New: newField})
+		}
+	}
+	return changes
+}
+
+func flatten_json(prefix string, value interface{}, out map[string]interface{}) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, child := range v {
+			flatten_json(join_path(prefix, key), child, out)
+		}
+	case []interface{}:
+		for i, child := range v {
+			flatten_json(join_path(prefix, strconv.Itoa(i)), child, out)
+		}
+	default:
+		out[prefix] = v                                      //string, float64, bool or nil, all comparable
+	}
+}
+
+func join_path(prefix string, key string) string {
+	if prefix == "" {
+		return key
+	}
+	return prefix + "." + key
+}
+
+// ============================================================================================================================
+// Get Marble Ids - id of every marble ever stored, deleted ones included, sorted
+//
+// Marbles written before the "marble~id" registry existed are found by their key range as long as they were not deleted.
+// ============================================================================================================================
+func get_marble_ids(stub shim.ChaincodeStubInterface) ([]string, error) {
+	seen := map[string]bool{}
+	var ids []string
+
+	registryIterator, err := stub.GetStateByPartialCompositeKey("marble~id", []string{})
+	if err != nil {
+		return ids, err
+	}
+	defer registryIterator.Close()
+	for registryIterator.HasNext() {
+		aKeyValue, err := registryIterator.Next()
+		if err != nil {
+			return ids, err
+		}
+		_, keyParts, err := stub.SplitCompositeKey(aKeyValue.Key)
+		if err != nil || len(keyParts) != 1 {
+			continue
+		}
+		if !seen[keyParts[0]] {
+			seen[keyParts[0]] = true
+			ids = append(ids, keyParts[0])
+		}
+	}
+
+	resultsIterator, err := stub.GetStateByRange("m0", "m9999999999999999999")
+	if err != nil {
+		return ids, err
+	}
+	defer resultsIterator.Close()
+	for resultsIterator.HasNext() {
+		aKeyValue, err := resultsIterator.Next()
+		if err != nil {
+			return ids, err
+		}
+		if !seen[aKeyValue.Key] {
+			seen[aKeyValue.Key] = true
+			ids = append(ids, aKeyValue.Key)
+		}
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// ============================================================================================================================
+// Get Marble At - the marble as it was at a point in time, rebuilt from its history
+//
+// found is false when the marble did not exist yet or had been deleted at that time.
+// ============================================================================================================================
+func get_marble_at(stub shim.ChaincodeStubInterface, id string, at time.Time) (marble Marble, found bool, err error) {
+	resultsIterator, err := stub.GetHistoryForKey(id)
+	if err != nil {
+		return marble, false, err
+	}
+	defer resultsIterator.Close()
+
+	var valueAsBytes []byte
+	var latest time.Time
+	for resultsIterator.HasNext() {
+		historyData, err := resultsIterator.Next()
+		if err != nil {
+			return marble, false, err
+		}
+		ts, err := ptypes.Timestamp(historyData.Timestamp)
+		if err != nil || ts.After(at) || ts.Before(latest) {
+			continue                                         //the newest modification not after "at" wins
+		}
+		latest = ts
+		if historyData.IsDelete {
+			valueAsBytes = nil
+		} else {
+			valueAsBytes = historyData.Value
+		}
+	}
+	if len(valueAsBytes) == 0 {
+		return marble, false, nil
+	}
+	err = json.Unmarshal(valueAsBytes, &marble)
+	return marble, err == nil, err
+}
+
+// ============================================================================================================================
+// Marble Participants - id of every user taking part in a marble, sorted
+//
+// The holder, former holders, the user a transfer is pending for, and whoever works or worked on one of its stages.
+// ============================================================================================================================
+func marble_participants(marble Marble) []string {
+	seen := map[string]bool{}
+	var ids []string
+	add := func(id string) {
+		if id != "" && !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	add(marble.User.Id)
+	for _, title := range marble.Titles {
+		add(title.From)
+		if title.Status != "rejected" {
+			add(title.To)
+		}
+	}
+	for _, check := range marble.Check {
+		add(check.UserID)
+		for _, id := range check.Reviewers {
+			add(id)
+		}
+	}
+	if marble.Syndication != nil {
+		for _, tranche := range marble.Syndication.Tranches {
+			add(tranche.Bank)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// ============================================================================================================================
+// Index Marble - keep the "user~marble" and the stats indexes in step with a marble, before it is written
+//
+// Entries of users no longer taking part are removed and new ones added; a nil marble removes them all (deletion).
+// The stats entries are done by index_stats.
+// ============================================================================================================================
+func index_marble(stub shim.ChaincodeStubInterface, id string, marble *Marble) error {
+	var participants []string
+	if marble != nil {
+		participants = marble_participants(*marble)
+	}
+	wanted := map[string]bool{}
+	for _, userID := range participants {
+		wanted[userID] = true
+	}
+
+	oldAsBytes, err := stub.GetState(id)
+	if err != nil {
+		return errors.New("Failed to get marble - " + id)
+	}
+	var old *Marble
+	if len(oldAsBytes) > 0 {
+		old = &Marble{}
+		json.Unmarshal(oldAsBytes, old)
+		for _, userID := range marble_participants(*old) {
+			if wanted[userID] {
+				continue
+			}
+			indexKey, err := stub.CreateCompositeKey("user~marble", []string{userID, id})
+			if err != nil {
+				return err
+			}
+			err = stub.DelState(indexKey)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, userID := range participants {
+		indexKey, err := stub.CreateCompositeKey("user~marble", []string{userID, id})
+		if err != nil {
+			return err
+		}
+		err = stub.PutState(indexKey, []byte{0x00})
+		if err != nil {
+			return err
+		}
+	}
+	return index_stats(stub, old, marble)
+}
+
+// the "user~marble" index is complete once rebuild_indexes went through every marble, or when there was none to index
+func indexes_built(stub shim.ChaincodeStubInterface) (bool, error) {
+	builtAsBytes, err := stub.GetState("indexes_built")
+	if err != nil {
+		return false, errors.New("Failed to get indexes_built")
+	}
+	return len(builtAsBytes) != 0, nil
+}
+
+// id of every marble a user takes part in, from the "user~marble" index
+func get_user_marble_ids(stub shim.ChaincodeStubInterface, userID string) ([]string, error) {
+	var ids []string
+	resultsIterator, err := stub.GetStateByPartialCompositeKey("user~marble", []string{userID})
+	if err != nil {
+		return ids, err
+	}
+	defer resultsIterator.Close()
+	for resultsIterator.HasNext() {
+		aKeyValue, err := resultsIterator.Next()
+		if err != nil {
+			return ids, err
+		}
+		_, keyParts, err := stub.SplitCompositeKey(aKeyValue.Key)
+		if err != nil || len(keyParts) != 2 {
+			continue
+		}
+		ids = append(ids, keyParts[1])
+	}
+	return ids, nil
+}
+
+// the transfer of a marble waiting for the core enterprise, nil when there is none
+func pending_title(marble *Marble) *TitleTransfer {
+	if n := len(marble.Titles); n > 0 && marble.Titles[n-1].Status == "pending" {
+		return &marble.Titles[n-1]
+	}
+	return nil
+}
+
+// the product of a marble, marbles from before products existed are receivables
+func marble_product(marble Marble) string {
+	if marble.Product == "" {
+		return Receivable
+	}
+	return marble.Product
+}
+
+// the route a marble follows before routing rules are applied
+func base_route(marble Marble) []int {
+	if marble_product(marble) == Reverse {
+		return Reverse_route
+	}
+	return Default_route
+}
+
+// the stage after which both the supplier and the core enterprise agreed to the marble
+func intake_done(marble Marble) int {
+	return base_route(marble)[1]
 }
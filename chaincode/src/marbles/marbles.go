@@ -31,7 +31,12 @@ type SimpleChaincode struct {
 }
 
 const (
-	StepNum = 8
+	StepNum = 9
+	DateLayout = "2006-01-02 15:04:05"     //all dates on the ledger use this layout, taken from the tx timestamp (UTC)
+	PrivateCollection = "collectionMarblePrivate"  //supplier, core enterprise and bank, see collections_config.json
+	BatchMax = 500                         //most marbles one batch transaction may create or review
+	AuditorCompany = "auditor"             //只读的审计角色, 可以查看所有机构的数据, 不能做任何写操作
+	RatePublisherCompany = "rate-publisher" //发布汇率的机构, 见fx.go
 )
 //申请所处的各个阶段
 const (
@@ -43,6 +48,7 @@ const (
 	SuppRepayment     //供应商还款                  5
 	BankRecv          //银行确认收款                6
 	EndOf             //包括成功和失败两种情况        7
+	RiskCheck         //风控委员会审核(由路由规则加入)   8
 )
 //确认阶段
 const(
@@ -51,13 +57,51 @@ const(
 	Success
 	Failure
 )
+//申请的状态, 空字符串表示正常流转
+const(
+	Disputed = "disputed"     //争议中, 所有流转被冻结
+	Split    = "split"        //金额已全部拆分给子marble, 本marble结束
+)
+//产品类型
+const(
+	Receivable = "receivable" //应收账款融资, 供应商发起 (默认)
+	Reverse    = "reverse"    //反向保理, 核心企业发起
+)
 //var Step_Company[StepNum]string
 
 //{                    "enrollId": "core-enterprise",                    "enrollSecret": "cepw"                },
 //{                    "enrollId": "bank",                    "enrollSecret": "bankpw"                },
 //{                    "enrollId": "auditor",                    "enrollSecret": "auditor"                }
-//                                     0                 1          2       3              4            5          6      7
-var Step_company  =[StepNum]string {"supplier","core-enterprise","bank","supplier","core-enterprise","supplier","bank","bank"}
+//                                     0                 1          2       3              4            5          6      7          8
+var Step_company  =[StepNum]string {"supplier","core-enterprise","bank","supplier","core-enterprise","supplier","bank","bank","risk-committee"}
+var Step_name     =[StepNum]string {"New","CompanyCheck","BankCheck","SuppRecv","CompanyRePayMent","SuppRepayment","BankRecv","EndOf","RiskCheck"}
+
+//不修改账本的函数, 审计角色只能调用这些
+var Read_functions = map[string]bool{
+	"read": true, "read_everything": true, "getHistory": true, "getMarblesByRange": true,
+	"read_allmarble": true, "read_allstate": true, "read_quorum_rules": true, "read_routing_rules": true,
+	"explain_route": true, "read_workflow": true, "sla_report": true, "read_escalation_chain": true,
+	"verify_document": true, "read_marble_private": true, "read_org_msps": true, "audit_report": true,
+	"read_marble_at": true, "read_portfolio_at": true, "verify_marble_chain": true,
+	"get_syndication": true, "read_fx_rate": true, "get_portfolio_stats": true,
+	"get_aging_report": true, "export_marbles": true,
+}
+
+//写账本的函数中, 代表操作人(用户id或公司)的参数位置; 这些参数不能是审计角色. 不在表中的函数(如init_owner)不检查参数
+var Actor_arguments = map[string][]int{
+	"delete_marble": {1}, "init_marble": {4, 5}, "init_marbles_batch": {1}, "split_marble": {1},
+	"assign_marble": {1}, "acknowledge_assignment": {1}, "invite_participant": {1}, "approve_tranche": {1},
+	"upload_payable": {5}, "offer_discount": {1}, "accept_discount": {1}, "publish_fx_rate": {0},
+	"set_currency": {1}, "disable_owner": {1}, "review_marble": {1}, "review_marbles_batch": {1},
+	"tx_marble": {1}, "set_quorum_rule": {4}, "set_routing_rule": {6}, "delete_routing_rule": {1},
+	"set_stage_sla": {3}, "set_escalation_chain": {3}, "open_dispute": {1}, "add_dispute_evidence": {1},
+	"resolve_dispute": {1}, "attach_document": {1},
+}
+
+//默认的审核路径, 路由规则在此基础上增加或跳过阶段
+var Default_route = []int{New, CompanyCheck, BankCheck, SuppRecv, CompanyRePayMent, SuppRepayment, BankRecv, EndOf}
+//反向保理: 核心企业上传已确认的应付账款(CompanyCheck), 供应商选择提前收款(New)后再由银行审核
+var Reverse_route = []int{CompanyCheck, New, BankCheck, SuppRecv, CompanyRePayMent, SuppRepayment, BankRecv, EndOf}
 // ============================================================================================================================
 // Asset Definitions - The ledger will store marbles and owners
 // ============================================================================================================================
@@ -69,8 +113,168 @@ type Marble struct {
 	Contact    string             `json:"contact"` //contract num
 	Balance    int                `json:"balance"`  //the balance of contract
 	Title      string             `json:"title"`
+	Product    string             `json:"product,omitempty"` //"receivable"(为空时同) 或 "reverse"
 	User       UserRelation       `json:"user"`  //User
 	Check      [StepNum]CheckInfo `json:"check"` //申请审核进度 0生成 1供应商 2 核心企业 3 银行 4 银行放款 5供应商收款 6供应商还款  7完成
+	Route      []int              `json:"route,omitempty"` //本申请的审核路径(阶段顺序), 为空时使用Default_route
+	Rules      []string           `json:"rules,omitempty"` //生成路径时触发的路由规则id
+	Status     string             `json:"status,omitempty"` //""正常 "disputed"争议中 "split"已全部拆分
+	Disputes   []Dispute          `json:"disputes,omitempty"` //争议记录, 最后一个可能仍未解决
+	Documents  []Document         `json:"documents,omitempty"` //发票、送货单、合同等附件的登记
+	PrivateHash string            `json:"private_hash,omitempty"` //商业条款在私有数据集合中时, 其sha256; 此时balance为0
+	Encrypted  bool               `json:"encrypted,omitempty"`   //contact, balance, comment 用transient中的密钥加密
+	KeyId      string             `json:"key_id,omitempty"`      //加密密钥的标识(不是密钥本身)
+	BalanceEnc string             `json:"balance_enc,omitempty"` //加密后的balance, 此时balance为0
+	ModifiedBy Actor              `json:"modified_by"`           //最后一次修改本marble的交易提交者
+	ChainHead  string             `json:"chain_head,omitempty"`  //最后一个审核决定的hash, 见chain.go
+	Parent     string             `json:"parent,omitempty"`      //拆分自哪个marble
+	Children   []string           `json:"children,omitempty"`    //拆分出的子marble
+	Titles     []TitleTransfer    `json:"titles,omitempty"`      //收款权转让记录(chain of title), 最后一个可能待核心企业确认
+	Syndication *Syndication      `json:"syndication,omitempty"` //多家银行共同放款, 见syndication.go
+	DueDate    string             `json:"due_date,omitempty"`    //核心企业的付款到期日 2006-01-02
+	Discount   *Discount          `json:"discount,omitempty"`    //核心企业提前付款的报价, 见discount.go
+	Currency   string             `json:"currency,omitempty"`      //应收账款的币种, 为空时不做换算
+	LoanCurrency string           `json:"loan_currency,omitempty"` //放款的币种
+	Fx         []FxSnapshot       `json:"fx,omitempty"`          //放款、收款时换算用的汇率, 见fx.go
+}
+
+// ----- FX Rate ----- //       units of the quote currency for one of the base, stored under "fx~pair~effective"
+type FxRate struct{
+	ObjectType  string `json:"docType"`       //"fx_rate"
+	Base        string `json:"base"`
+	Quote       string `json:"quote"`
+	RateMicros  int64  `json:"rate_micros"`   //rate * 1000000
+	Effective   string `json:"effective"`     //in use from then until the next rate of the pair
+	Publisher   string `json:"publisher"`     //user id
+	PublishedAt string `json:"published_at"`
+}
+
+// ----- FX Snapshot ----- //   the rate a bank stage of a marble was converted with
+type FxSnapshot struct{
+	Step       int    `json:"step"`          //BankCheck (financing) or BankRecv (repayment)
+	Date       string `json:"date"`
+	Key        string `json:"key"`           //ledger key of the FxRate
+	Base       string `json:"base"`
+	Quote      string `json:"quote"`
+	RateMicros int64  `json:"rate_micros"`
+	Effective  string `json:"effective"`
+	Publisher  string `json:"publisher"`
+	Inverse    bool   `json:"inverse,omitempty"`   //the rate is quoted the other way round, divided by
+	Amount     int    `json:"amount,omitempty"`    //in the marble currency, left out for private marbles
+	Converted  int    `json:"converted,omitempty"` //in the loan currency
+}
+
+// ----- Discount ----- //      the core enterprise paying a receivable early from its own cash, less a discount
+type Discount struct{
+	AprBps     int            `json:"apr_bps,omitempty"`     //annual rate, earned for every day paid early
+	Scale      []DiscountTier `json:"scale,omitempty"`       //or a fixed rate by how many days early
+	OfferedBy  string         `json:"offered_by"`            //user id of the core enterprise
+	OfferedAt  string         `json:"offered_at"`
+	Expires    string         `json:"expires,omitempty"`     //the supplier must accept by then, empty for no limit
+	Status     string         `json:"status"`                //"offered" or "accepted"
+	AcceptedBy string         `json:"accepted_by,omitempty"`
+	AcceptedAt string         `json:"accepted_at,omitempty"`
+	DaysEarly  int            `json:"days_early,omitempty"`  //whole days before the due date, at acceptance
+	RateBps    int            `json:"rate_bps,omitempty"`    //the discount as a share of the balance
+	Amount     int            `json:"amount,omitempty"`      //the discount
+	Paid       int            `json:"paid,omitempty"`        //balance - amount, paid to the supplier
+}
+
+type DiscountTier struct{
+	MinDaysEarly int `json:"min_days_early"`  //the rate applies from this many days before the due date
+	RateBps      int `json:"rate_bps"`        //of the balance
+}
+
+// ----- Syndication ----- //   banks sharing the financing of a marble, the lead bank's tranche comes first
+type Syndication struct{
+	Lead     string    `json:"lead"`       //user id of the lead bank
+	Tranches []Tranche `json:"tranches"`
+}
+
+type Tranche struct{
+	Bank     string `json:"bank"`         //user id
+	Company  string `json:"company"`
+	ShareBps int    `json:"share_bps"`    //share of the financing, all tranches add up to 10000
+	Status   string `json:"status"`       //"invited", "approved" or "declined"
+	Date     string `json:"date"`
+	Comment  string `json:"comment,omitempty"`
+	Amount   int    `json:"amount"`       //financed by this bank, allocated at BankCheck
+	Repaid   int    `json:"repaid"`       //paid back to this bank, allocated at BankRecv
+}
+
+// ----- Title Transfer ----- //  the right to collect passing from one supplier to another
+type TitleTransfer struct{
+	From        string `json:"from"`          //user id of the holder giving it up
+	To          string `json:"to"`            //user id of the new holder
+	RequestedAt string `json:"requested_at"`
+	Status      string `json:"status"`        //"pending", "acknowledged" or "rejected"
+	AckBy       string `json:"ack_by,omitempty"`  //the core enterprise user who answered
+	AckAt       string `json:"ack_at,omitempty"`
+	Comment     string `json:"comment,omitempty"`
+}
+
+// ----- Field Change ----- //   one field of a marble that differs from the previous version, see getHistory
+type FieldChange struct{
+	Field string      `json:"field"`      //dotted path, e.g. "check.2.review"
+	Old   interface{} `json:"old"`
+	New   interface{} `json:"new"`
+}
+
+// ----- Actor ----- //          the identity that submitted a transaction, from its certificate
+type Actor struct{
+	MSP string `json:"msp"`
+	ID  string `json:"id"`         //cid.GetID, unique within the MSP
+}
+
+// ----- Marble Private ----- //  commercial terms kept in PrivateCollection, passed in through the transient map
+type MarblePrivate struct{
+	ObjectType   string        `json:"docType"`
+	Id           string        `json:"id"`
+	Balance      int           `json:"balance"`
+	InterestRate int           `json:"interest_rate_bps"`  //年利率, 基点
+	BankComments []BankComment `json:"bank_comments"`
+	Salt         string        `json:"salt"`               //random, hex; without it the hash could be brute-forced
+}
+
+type BankComment struct{
+	Step    int    `json:"step"`
+	UserID  string `json:"userid"`
+	Date    string `json:"date"`
+	Comment string `json:"comment"`
+}
+
+// ----- Document ----- //       an attachment registered by its content hash, the file itself stays off-chain
+type Document struct{
+	DocType  string `json:"doc_type"`   //invoice, delivery_note, contract or other
+	Hash     string `json:"hash"`       //sha256 of the file, lower case hex
+	FileName string `json:"file_name"`
+	Size     int64  `json:"size"`       //bytes
+	Uploader string `json:"uploader"`   //user id
+	Stage    int    `json:"stage"`      //the stage the marble was at when the document was attached
+	Date     string `json:"date"`
+}
+
+// ----- Dispute ----- //        a contested receivable, freezes the marble until resolved
+type Dispute struct{
+	OpenedBy   string     `json:"opened_by"`
+	Company    string     `json:"company"`
+	Reason     string     `json:"reason"`
+	Date       string     `json:"date"`
+	Step       int        `json:"step"`        //the stage that was pending when the dispute was opened
+	Evidence   []Evidence `json:"evidence"`
+	Status     string     `json:"status"`      //"open", "resumed" or "terminated"
+	ResolvedBy string     `json:"resolved_by,omitempty"`
+	ResolvedAt string     `json:"resolved_at,omitempty"`
+	Comment    string     `json:"comment,omitempty"`
+	OldBalance int        `json:"old_balance"`
+	NewBalance int        `json:"new_balance"`
+}
+
+type Evidence struct{
+	Hash    string `json:"hash"`    //sha256 of the document, hex
+	Comment string `json:"comment"`
+	UserID  string `json:"userid"`
+	Date    string `json:"date"`
 }
 
 // ----- User ----- //               User
@@ -94,6 +298,75 @@ type CheckInfo struct{
 	Date    string `json:"date"`      //操作的日期
 	Review  int    `json:"review"`    //确认阶段{ 0:不需要确认 1:待确认 2:成功 3:失败 }
 	Comment string `json:"comment"`   //备注
+	Reviewers  []string    `json:"reviewers,omitempty"`  //会签人员的userid, 为空时由UserID一人审核
+	Quorum     int         `json:"quorum,omitempty"`     //会签通过需要的同意人数
+	Signatures []Signature `json:"signatures,omitempty"` //会签阶段每个人的签署记录
+	EnteredAt  string      `json:"entered_at,omitempty"` //进入本阶段(开始等待)的时间
+	Deadline   string      `json:"deadline,omitempty"`   //按SLA计算的处理期限, 为空表示不限
+	Escalated  bool        `json:"escalated,omitempty"`  //已超过期限并升级处理
+	Reassignments []Reassignment `json:"reassignments,omitempty"` //升级时改派给上级的记录
+	Seq        int         `json:"seq,omitempty"`        //本决定在hash链中的序号, 从1开始, 0表示尚未决定
+	PrevHash   string      `json:"prev_hash,omitempty"`  //上一个决定的hash, 第一个决定为空
+	Hash       string      `json:"hash,omitempty"`       //sha256(prev_hash + 决定内容), 见chain.go
+}
+
+// ----- Reassignment ----- //   a pending stage handed over to a supervisor
+type Reassignment struct{
+	From   string `json:"from"`
+	To     string `json:"to"`
+	Date   string `json:"date"`
+	Reason string `json:"reason"`
+}
+
+// ----- Signature ----- //      one reviewer's decision inside a quorum stage
+type Signature struct{
+	UserID  string `json:"userid"`
+	Company string `json:"company"`
+	Date    string `json:"date"`
+	Review  int    `json:"review"`    //2:同意 3:拒绝
+	Comment string `json:"comment"`
+}
+
+// ----- Workflow ----- //       the workflow definition: service level of every stage
+type Workflow struct{
+	ObjectType   string     `json:"docType"`
+	Stages       []StageDef `json:"stages"`
+	DefaultRoute []int      `json:"default_route,omitempty"`  //Default_route, filled in on read for offline verification
+	ProductRoutes map[string][]int `json:"product_routes,omitempty"` //base route of each product, filled in on read
+}
+
+type StageDef struct{
+	Step     int    `json:"step"`
+	Name     string `json:"name"`
+	Company  string `json:"company"`
+	SlaHours int    `json:"sla_hours"`  //0 = no deadline
+	OnExpire string `json:"on_expire"`  //"fail" or "escalate" once the deadline has passed
+}
+
+// ----- Escalation Chain ----- //   supervisors of one organization, in escalation order
+type EscalationChain struct{
+	ObjectType  string   `json:"docType"`
+	Company     string   `json:"company"`
+	AfterHours  int      `json:"after_hours"`  //a pending step may be escalated after waiting this long
+	Supervisors []string `json:"supervisors"`
+}
+
+// ----- Routing Rule ----- //   adds or skips a stage for marbles with min_balance <= balance < max_balance (max 0 = unbounded)
+type RoutingRule struct{
+	Id         string `json:"id"`
+	MinBalance int    `json:"min_balance"`
+	MaxBalance int    `json:"max_balance"`
+	Action     string `json:"action"`   //"add" or "skip"
+	Step       int    `json:"step"`     //the stage added or skipped
+	After      int    `json:"after"`    //"add" only: the stage the new one follows
+}
+
+// ----- Quorum Rule ----- //    N-of-M approval rule of one stage, the rule with the highest min_balance <= balance is used
+type QuorumRule struct{
+	Step       int      `json:"step"`
+	MinBalance int      `json:"min_balance"`
+	Quorum     int      `json:"quorum"`
+	Reviewers  []string `json:"reviewers"`
 }
 
 // ============================================================================================================================
@@ -170,6 +443,43 @@ func (t *SimpleChaincode) Init(stub shim.ChaincodeStubInterface) pb.Response {
 		return shim.Error(err.Error())
 	}
 
+	// the organization that instantiated the chaincode administers it, see register_org_msp. Upgrades keep it
+	adminAsBytes, err := stub.GetState("admin_msp")
+	if err != nil {
+		return shim.Error("Failed to get admin msp")
+	}
+	if len(adminAsBytes) == 0 {
+		msp, err := get_invoker_msp(stub)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		err = stub.PutState("admin_msp", []byte(msp))
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	// without any marble there is nothing to index. After upgrading a chaincode that has marbles, read_allmarble
+	// scans them until the admin ran rebuild_indexes
+	built, err := indexes_built(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if !built {
+		resultsIterator, err := stub.GetStateByRange("m0", "m9999999999999999999")
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		empty := !resultsIterator.HasNext()
+		resultsIterator.Close()
+		if empty {
+			err = stub.PutState("indexes_built", []byte("true"))
+			if err != nil {
+				return shim.Error(err.Error())
+			}
+		}
+	}
+
 	fmt.Println("Ready for action")                          //self-test pass
 	return shim.Success(nil)
 }
@@ -183,6 +493,13 @@ func (t *SimpleChaincode) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
 	fmt.Println(" ")
 	fmt.Println("starting invoke, for - " + function)
 
+	// the auditor may read everything but write nothing
+	if !Read_functions[function] {
+		if err := check_not_auditor(stub, function, args); err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
 	// Handle different functions
 	if function == "init" {                    //initialize the chaincode state, used as reset
 		return t.Init(stub)
@@ -194,6 +511,40 @@ func (t *SimpleChaincode) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
 		return delete_marble(stub, args)
 	} else if function == "init_marble" {      //create a new marble
 		return init_marble(stub, args)
+	}else if function == "init_marbles_batch"{ //create many marbles at once, all or none
+		return init_marbles_batch(stub, args)
+	}else if function == "split_marble"{      //pass part of an approved receivable to tier-2 suppliers
+		return split_marble(stub, args)
+	}else if function == "assign_marble"{     //ask to transfer the right to collect to another supplier
+		return assign_marble(stub, args)
+	}else if function == "acknowledge_assignment"{ //the core enterprise accepts or rejects a transfer
+		return acknowledge_assignment(stub, args)
+	}else if function == "rebuild_indexes"{   //rebuild the user~marble and stats indexes after upgrading, admin only
+		return rebuild_indexes(stub, args)
+	}else if function == "invite_participant"{ //the lead bank offers a share of the financing
+		return invite_participant(stub, args)
+	}else if function == "approve_tranche"{   //a participant bank answers its invitation
+		return approve_tranche(stub, args)
+	}else if function == "get_syndication"{
+		return get_syndication(stub, args)
+	}else if function == "upload_payable"{    //the core enterprise offers an approved payable for reverse factoring
+		return upload_payable(stub, args)
+	}else if function == "offer_discount"{    //the core enterprise offers to pay a receivable early
+		return offer_discount(stub, args)
+	}else if function == "accept_discount"{   //the supplier takes the early payment, the marble ends
+		return accept_discount(stub, args)
+	}else if function == "publish_fx_rate"{   //a rate publisher adds the rate of a currency pair
+		return publish_fx_rate(stub, args)
+	}else if function == "read_fx_rate"{
+		return read_fx_rate(stub, args)
+	}else if function == "set_currency"{      //the currencies of a cross-border marble
+		return set_currency(stub, args)
+	}else if function == "get_portfolio_stats"{ //counts and amounts by stage and counterparty of an organization
+		return get_portfolio_stats(stub, args)
+	}else if function == "get_aging_report"{ //outstanding loans by days past due
+		return get_aging_report(stub, args)
+	}else if function == "export_marbles"{   //marbles and their review trail as CSV or JSON Lines
+		return export_marbles(stub, args)
 	}else if function == "init_owner"{        //create a new marble owner
 		return init_owner(stub, args)
 	} else if function == "read_everything"{   //read everything, (owners + marbles + companies)
@@ -206,12 +557,64 @@ func (t *SimpleChaincode) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
 		return disable_owner(stub, args)
 	} else if function == "review_marble"{
 		return review_marble(stub,args)        //对marble的审核，或者放款，还款等操作
+	}else if function == "review_marbles_batch"{ //the same review for many marbles
+		return review_marbles_batch(stub,args)
 	}else if function == "read_allmarble"{
 		return read_allmarble(stub,args)       //通过userID查询所有的相关的marble
 	}else if function == "read_allstate"{      //
 		return read_allstate(stub,args)
 	}else if function == "tx_marble"{
 		return tx_marble(stub,args)
+	}else if function == "set_quorum_rule"{   //set the N-of-M approval rule of a stage
+		return set_quorum_rule(stub,args)
+	}else if function == "read_quorum_rules"{
+		return read_quorum_rules(stub,args)
+	}else if function == "set_routing_rule"{  //add or replace an amount based routing rule
+		return set_routing_rule(stub,args)
+	}else if function == "delete_routing_rule"{
+		return delete_routing_rule(stub,args)
+	}else if function == "read_routing_rules"{
+		return read_routing_rules(stub,args)
+	}else if function == "explain_route"{     //which routing rules fired for a marble
+		return explain_route(stub,args)
+	}else if function == "set_stage_sla"{     //set the deadline of a stage in the workflow definition
+		return set_stage_sla(stub,args)
+	}else if function == "read_workflow"{
+		return read_workflow(stub,args)
+	}else if function == "expire_stale"{      //fail or escalate waiting stages past their deadline (scheduler)
+		return expire_stale(stub,args)
+	}else if function == "sla_report"{        //SLA compliance per reviewer organization
+		return sla_report(stub,args)
+	}else if function == "set_escalation_chain"{
+		return set_escalation_chain(stub,args)
+	}else if function == "read_escalation_chain"{
+		return read_escalation_chain(stub,args)
+	}else if function == "escalate_marble"{   //reassign a stalled step to the next supervisor
+		return escalate_marble(stub,args)
+	}else if function == "open_dispute"{      //freeze a contested marble
+		return open_dispute(stub,args)
+	}else if function == "add_dispute_evidence"{
+		return add_dispute_evidence(stub,args)
+	}else if function == "resolve_dispute"{   //resume or terminate a disputed marble
+		return resolve_dispute(stub,args)
+	}else if function == "attach_document"{   //register a document hash on a marble
+		return attach_document(stub,args)
+	}else if function == "verify_document"{   //does a file match what was registered
+		return verify_document(stub,args)
+	}else if function == "read_marble_private"{ //read the private commercial terms of a marble
+		return read_marble_private(stub,args)
+	}else if function == "register_org_msp"{  //map a company to the MSP of its peers
+		return register_org_msp(stub,args)
+	}else if function == "read_org_msps"{
+		return read_org_msps(stub,args)
+	}else if function == "audit_report"{      //all state changes in a time window (auditor)
+		return audit_report(stub,args)
+	}else if function == "read_marble_at"{    //a marble as it was at a point in time
+		return read_marble_at(stub,args)
+	}else if function == "read_portfolio_at"{ //totals by stage and organization at a point in time
+		return read_portfolio_at(stub,args)
+	}else if function == "verify_marble_chain"{ //recompute the hash chain of the decisions of a marble
+		return verify_marble_chain(stub,args)
 	}
 
 	// error out
@@ -21,12 +21,19 @@ package main
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 
+	"github.com/golang/protobuf/ptypes"
 	"github.com/hyperledger/fabric/core/chaincode/shim"
 	pb "github.com/hyperledger/fabric/protos/peer"
+	"sort"
 	"strconv"
+	"strings"
+	"time"
 )
 
 // ============================================================================================================================
@@ -70,7 +77,9 @@ func read(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 // ============================================================================================================================
 // Get everything we need (owners + marbles + companies)
 //
-// Inputs - none
+// Inputs - none, or a company name to only get its marbles
+//          "auditor" gets the marbles of every company and the disabled owners as well, when the invoker is the
+//          auditor (see is_auditor_invoker)
 //
 // Returns:
 // {
@@ -101,7 +110,8 @@ func read_everything(stub shim.ChaincodeStubInterface,args []string) pb.Response
 		return shim.Error("Incorrect number of arguments. Expecting args num > 1")
 	}
 
-	if len(args) == 1{
+	auditor := len(args) == 1 && args[0] == AuditorCompany && is_auditor_invoker(stub) //the auditor sees every organization, disabled owners too
+	if len(args) == 1 && !auditor{
 		companyName := args[0]
 		user,err:=getUserByCompany(stub,companyName)
 		if err != nil {
@@ -122,17 +132,9 @@ func read_everything(stub shim.ChaincodeStubInterface,args []string) pb.Response
 
 		marblesNum := len(marbles)
 		for i:=0;i<marblesNum;i++{
-			if marbles[i].User.Id == user.Id{
+			//持有人, 或任何阶段(包括风控审核)的审核人
+			if is_participant(marbles[i], user.Id){
 				everything.Marbles = append(everything.Marbles, marbles[i])
-				continue
-			}
-
-			for j:=0;j<4;j++{
-				if marbles[i].Check[j].UserID == user.Id{
-					//needMarbles = append(needMarbles, marbles[i])
-					everything.Marbles = append(everything.Marbles, marbles[i])
-					continue
-				}
 			}
 		}
 
@@ -161,12 +163,18 @@ func read_everything(stub shim.ChaincodeStubInterface,args []string) pb.Response
 		var owner User
 		json.Unmarshal(queryValAsBytes, &owner)                   //un stringify it aka JSON.parse()
 
-		if owner.Enabled {                                        //only return enabled owners
+		if owner.Enabled || auditor {                             //only return enabled owners
 			everything.Owners = append(everything.Owners, owner)  //add this marble to the list
 		}
 	}
 	fmt.Println("owner array - ", everything.Owners)
 
+	//decrypt the marbles the caller passed the key for
+	err = open_marbles(stub, everything.Marbles)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
 	//change to array of bytes
 	everythingAsBytes, _ := json.Marshal(everything)              //convert to array of bytes
 	return shim.Success(everythingAsBytes)
@@ -177,6 +185,11 @@ func read_everything(stub shim.ChaincodeStubInterface,args []string) pb.Response
 //
 // Shows Off GetHistoryForKey() - reading complete history of a key/value
 //
+// Every entry has the tx timestamp, whether the marble was deleted, who submitted the transaction and the fields that
+// changed since the previous entry (dotted paths like "check.2.review"). An encrypted marble is decrypted when its key
+// is in the transient map; the decision hashes cover the encrypted comments, so export without the key for
+// marblesverify.
+//
 // Inputs - Array of strings
 //  0
 //  id
@@ -184,11 +197,14 @@ func read_everything(stub shim.ChaincodeStubInterface,args []string) pb.Response
 // ============================================================================================================================
 func getHistory(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 	type AuditHistory struct {
-		TxId    string   `json:"txId"`
-		Value   Marble   `json:"value"`
+		TxId       string        `json:"txId"`
+		Timestamp  string        `json:"timestamp"`
+		IsDelete   bool          `json:"is_delete"`
+		ModifiedBy Actor         `json:"modified_by"`      //empty for a delete, the marble is gone
+		Diff       []FieldChange `json:"diff"`
+		Value      Marble        `json:"value"`
 	}
 	var history []AuditHistory;
-	var marble Marble
 
 	if len(args) != 1 {
 		return shim.Error("Incorrect number of arguments. Expecting 1")
@@ -204,6 +220,7 @@ func getHistory(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 	}
 	defer resultsIterator.Close()
 
+	var previous []byte                                //previous version, decrypted if the key was passed
 	for resultsIterator.HasNext() {
 		historyData, err := resultsIterator.Next()
 		if err != nil {
@@ -212,14 +229,26 @@ func getHistory(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 		//historyData.Value
 		var tx AuditHistory
 		tx.TxId = historyData.TxId                     //copy transaction id over
-		json.Unmarshal(historyData.Value, &marble)     //un stringify it aka JSON.parse()
-		if historyData.Value == nil {                  //marble has been deleted
-			var emptyMarble Marble
-			tx.Value = emptyMarble                 //copy nil marble
+		tx.IsDelete = historyData.IsDelete
+		if ts, err := ptypes.Timestamp(historyData.Timestamp); err == nil {
+			tx.Timestamp = ts.UTC().Format(DateLayout)
+		}
+		var current []byte
+		if historyData.Value == nil || historyData.IsDelete {  //marble has been deleted
+			tx.IsDelete = true
 		} else {
+			var marble Marble                      //fresh each time, older versions must not leak in
 			json.Unmarshal(historyData.Value, &marble) //un stringify it aka JSON.parse()
+			err = open_marble(stub, &marble)
+			if err != nil {
+				return shim.Error(err.Error())
+			}
 			tx.Value = marble                      //copy marble over
+			tx.ModifiedBy = marble.ModifiedBy
+			current, _ = json.Marshal(marble)
 		}
+		tx.Diff = diff_json(previous, current, map[string]bool{"modified_by": true})
+		previous = current
 		history = append(history, tx)              //add this tx to the list
 	}
 	fmt.Printf("- getHistoryForMarble returning:\n%s", history)
@@ -309,15 +338,15 @@ const(
 )
 
 */
-//根据id查询所有相关的审核
-//       0
-//    userID
+//根据id查询所有相关的审核(查user~marble索引; 升级后rebuild_indexes完成前, 另扫描所有marble)
+//       0           1
+//    userID      product(可选, "receivable" 或 "reverse")
 //
 //
 func  read_allmarble(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 
-	if len(args) != 1 {
-		return shim.Error("Incorrect number of arguments. Expecting 2")
+	if len(args) != 1 && len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 1 or 2")
 	}
 	userID := args[0]
 	user, err := get_user(stub, userID)
@@ -331,31 +360,57 @@ func  read_allmarble(stub shim.ChaincodeStubInterface, args []string) pb.Respons
 		return shim.Error(err.Error())
 	}
 	var needMarbles []Marble
-	marbles,err:= getAllMarbles(stub)
-	if err != nil{
-		fmt.Println("getAllMarblesByUserID err :",err.Error())
-		return shim.Error(err.Error())
-	}
-
-	marblesNum := len(marbles)
-	if marblesNum <=0{
-		fmt.Println("There is no marbles")
-		return shim.Error("There is no marbles")
-	}
-
-	for i:=0;i<marblesNum;i++{
-		if marbles[i].User.Id == userID{
-			needMarbles = append(needMarbles, marbles[i])
-			continue
+	if is_auditor(user) && is_auditor_invoker(stub) {      //审计角色查看所有marble, 包括已终止的; 调用者须是审计方
+		needMarbles, err = getAllMarbles(stub)
+		if err != nil {
+			fmt.Println("getAllMarblesByUserID err :",err.Error())
+			return shim.Error(err.Error())
 		}
-
-		for j:=0;j<4;j++{
-			if marbles[i].Check[j].UserID == userID{
-				needMarbles = append(needMarbles, marbles[i])
-				continue
+	} else {
+		//user~marble索引记录了持有人、受让人和各阶段的审核人
+		ids, err := get_user_marble_ids(stub, userID)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		seen := map[string]bool{}
+		for _, id := range ids {
+			marble, err := get_marble(stub, id)
+			if err != nil {
+				continue                                   //index entry of a marble deleted before the index was kept
 			}
+			seen[id] = true
+			needMarbles = append(needMarbles, marble)
+		}
+		built, err := indexes_built(stub)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if !built {
+			//索引尚未重建, 升级前的marble没有索引条目, 逐个扫描
+			marbles, err := getAllMarbles(stub)
+			if err != nil {
+				return shim.Error(err.Error())
+			}
+			for _, marble := range marbles {
+				for _, id := range marble_participants(marble) {
+					if id == userID && !seen[marble.Id] {
+						seen[marble.Id] = true
+						needMarbles = append(needMarbles, marble)
+					}
+				}
+			}
+		}
+	}
+	if len(args) == 2 {
+		needMarbles, err = filter_product(needMarbles, args[1])
+		if err != nil {
+			return shim.Error(err.Error())
 		}
 	}
+	err = open_marbles(stub, needMarbles)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
 	marblesAsBytes, _:= json.Marshal(needMarbles)
 	return shim.Success(marblesAsBytes)
 
@@ -383,9 +438,9 @@ const(
 
 */
 //根据userId查询需要审核的申请
-//     0                    1                          2
-//   userID              查询阶段                     申请的状态
-//   "123456"        0～7（SuppApply）          1（waite） 2（success）3（failure）
+//     0                    1                          2                                   3
+//   userID              查询阶段                     申请的状态                           product(可选)
+//   "123456"        0～7（SuppApply）          1（waite） 2（success）3（failure）     "receivable" 或 "reverse"
 //-------------------------------------------------------------------------------
 //example 1
 //  供应商查询银行所有审核通过的申请
@@ -401,12 +456,19 @@ const(
 //
 func  read_allstate(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 
-	if len(args) != 3 {
-		return shim.Error("Incorrect number of arguments. Expecting 2")
+	if len(args) != 3 && len(args) != 4 {
+		return shim.Error("Incorrect number of arguments. Expecting 3 or 4")
 	}
 	userID := args[0]
 	stage,err:= strconv.Atoi(args[1])   //阶段
+	if err != nil || stage < 0 || stage >= StepNum {
+		return shim.Error("2nd argument must be a stage from 0 to " + strconv.Itoa(StepNum-1))
+	}
 	state,err := strconv.Atoi(args[2])  //状态
+	if err != nil {
+		return shim.Error("3rd argument must be a numeric string")
+	}
+	user, _ := get_user(stub, userID)
 	var needMarbles []Marble
 	marbles,err:= getAllMarbles(stub)
 	if err != nil{
@@ -420,26 +482,697 @@ func  read_allstate(stub shim.ChaincodeStubInterface, args []string) pb.Response
 		return shim.Error("There is no marbles")
 	}
 
+	auditor := is_auditor(user) && is_auditor_invoker(stub)
 	for i:=0;i<marblesNum;i++{
-		if marbles[i].User.Id == userID{
+		//审计角色查看所有marble, 其他用户查看自己持有或参与审核(包括风控审核)的marble
+		if is_participant(marbles[i], userID) || auditor{
 			if marbles[i].Check[stage].Review == state{
 				//查询到对应阶段的对应状态
 				needMarbles = append(needMarbles, marbles[i])
 			}
-			continue
 		}
+	}
+	if len(args) == 4 {
+		needMarbles, err = filter_product(needMarbles, args[3])
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+	err = open_marbles(stub, needMarbles)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	marblesAsBytes, _:= json.Marshal(needMarbles)
+	return shim.Success(marblesAsBytes)
+
+}
+
+
+// ============================================================================================================================
+// Read Quorum Rules - get the N-of-M approval rules of every stage
+//
+// Inputs - none
+// ============================================================================================================================
+func read_quorum_rules(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	rules, err := get_quorum_rules(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	rulesAsBytes, _ := json.Marshal(rules)
+	return shim.Success(rulesAsBytes)
+}
 
-		for j:=0;j<4;j++{
-			if marbles[i].Check[j].UserID == userID{
-				if marbles[i].Check[stage].Review == state{
-					//查询到对应阶段的对应状态
-					needMarbles = append(needMarbles, marbles[i])
+// ============================================================================================================================
+// Read Routing Rules - get all amount based routing rules
+//
+// Inputs - none
+// ============================================================================================================================
+func read_routing_rules(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	rules, err := get_routing_rules(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	rulesAsBytes, _ := json.Marshal(rules)
+	return shim.Success(rulesAsBytes)
+}
+
+// ============================================================================================================================
+// Explain Route - show which routing rules fire for a marble and the route they produce
+//
+// Inputs - Array of strings
+//       0
+//   marble id
+//  "m999999999"
+//
+// Returns:
+// {
+//	"id": "m999999999",
+//	"balance": 2000000,
+//	"default_route": ["New","CompanyCheck","BankCheck",...],
+//	"route": ["New","CompanyCheck","BankCheck","RiskCheck",...],     //route with the current rules
+//	"recorded_route": [...], "recorded_rules": ["risk"],             //route stored on the marble at its last transition
+//	"rules": [{"rule": {...}, "fired": true, "reason": "balance 2000000 in [1000000, unbounded)"}]
+// }
+// ============================================================================================================================
+func explain_route(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	type RuleResult struct {
+		Rule   RoutingRule `json:"rule"`
+		Fired  bool        `json:"fired"`
+		Reason string      `json:"reason"`
+	}
+	type Explanation struct {
+		Id            string       `json:"id"`
+		Balance       int          `json:"balance"`
+		DefaultRoute  []string     `json:"default_route"`
+		Route         []string     `json:"route"`
+		RecordedRoute []string     `json:"recorded_route"`
+		RecordedRules []string     `json:"recorded_rules"`
+		Rules         []RuleResult `json:"rules"`
+	}
+	var explanation Explanation
+
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+
+	marble, err := get_marble(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	rules, err := get_routing_rules(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	balance, err := marble_balance(stub, marble)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	marble.Balance = balance
+
+	route, fired := compute_route(base_route(marble), rules, marble.Balance)
+	recorded := marble.Route
+	if len(recorded) == 0 {
+		recorded = base_route(marble)
+	}
+	explanation.Id = marble.Id
+	explanation.Balance = marble.Balance
+	explanation.DefaultRoute = route_names(base_route(marble))
+	explanation.Route = route_names(route)
+	explanation.RecordedRoute = route_names(recorded)
+	explanation.RecordedRules = marble.Rules
+
+	for _, rule := range rules {
+		var result RuleResult
+		result.Rule = rule
+		window := "[" + strconv.Itoa(rule.MinBalance) + ", unbounded)"
+		if rule.MaxBalance > 0 {
+			window = "[" + strconv.Itoa(rule.MinBalance) + ", " + strconv.Itoa(rule.MaxBalance) + ")"
+		}
+		if !rule_matches(rule, marble.Balance) {
+			result.Reason = "balance " + strconv.Itoa(marble.Balance) + " not in " + window
+		} else {
+			for _, id := range fired {
+				if id == rule.Id {
+					result.Fired = true
 				}
+			}
+			if result.Fired {
+				result.Reason = "balance " + strconv.Itoa(marble.Balance) + " in " + window
+			} else if rule.Action == "add" {
+				result.Reason = "balance in " + window + " but " + Step_name[rule.Step] + " is already on the route or " + Step_name[rule.After] + " is not"
+			} else {
+				result.Reason = "balance in " + window + " but " + Step_name[rule.Step] + " is not on the route"
+			}
+		}
+		explanation.Rules = append(explanation.Rules, result)
+	}
+
+	explanationAsBytes, _ := json.Marshal(explanation)
+	return shim.Success(explanationAsBytes)
+}
+
+// stage names of a route, for humans
+func route_names(route []int) []string {
+	var names []string
+	for _, step := range route {
+		names = append(names, Step_name[step])
+	}
+	return names
+}
+
+// ============================================================================================================================
+// Read Workflow - get the workflow definition (stage order, owning companies and SLAs)
+//
+// Inputs - none
+// ============================================================================================================================
+func read_workflow(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	workflow, err := get_workflow(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	workflowAsBytes, _ := json.Marshal(workflow)
+	return shim.Success(workflowAsBytes)
+}
+
+// ============================================================================================================================
+// SLA Report - how fast every reviewer organization handles its stages
+//
+// A stage counts as late when it was decided after its deadline, and as overdue while it is still waiting
+// past its deadline at the tx timestamp.
+//
+// Inputs - Array of strings
+//       0
+//   company (optional, all companies when omitted)
+//   "bank"
+//
+// Returns:
+// [{"company": "bank", "entered": 10, "decided": 8, "on_time": 7, "late": 1, "pending": 2, "overdue": 1,
+//   "escalated": 1, "avg_hours": 20.5}]
+// ============================================================================================================================
+func sla_report(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	type CompanySLA struct {
+		Company   string  `json:"company"`
+		Entered   int     `json:"entered"`
+		Decided   int     `json:"decided"`
+		OnTime    int     `json:"on_time"`
+		Late      int     `json:"late"`
+		Pending   int     `json:"pending"`
+		Overdue   int     `json:"overdue"`
+		Escalated int     `json:"escalated"`
+		AvgHours  float64 `json:"avg_hours"`
+	}
+	var report []CompanySLA
+
+	if len(args) > 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 0 or 1")
+	}
+
+	now, err := get_tx_time(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	date := now.Format(DateLayout)
+	marbles, err := getAllMarbles(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	index := map[string]int{}
+	totalHours := map[string]float64{}
+	for _, marble := range marbles {
+		for step := 1; step < StepNum; step++ {
+			check := marble.Check[step]
+			if check.EnteredAt == "" || step == EndOf {
 				continue
 			}
+			company := check.Company
+			if company == "" {
+				company = Step_company[step]
+			}
+			if len(args) == 1 && company != args[0] {
+				continue
+			}
+			if _, ok := index[company]; !ok {
+				index[company] = len(report)
+				report = append(report, CompanySLA{Company: company})
+			}
+			stats := &report[index[company]]
+
+			stats.Entered++
+			if check.Escalated {
+				stats.Escalated++
+			}
+			if check.Review == Wait {
+				stats.Pending++
+				if check.Deadline != "" && check.Deadline < date {
+					stats.Overdue++
+				}
+				continue
+			}
+			if check.Review != Success && check.Review != Failure {
+				continue
+			}
+			stats.Decided++
+			if check.Deadline != "" && check.Date > check.Deadline {
+				stats.Late++
+			} else {
+				stats.OnTime++
+			}
+			entered, err1 := time.Parse(DateLayout, check.EnteredAt)
+			decided, err2 := time.Parse(DateLayout, check.Date)
+			if err1 == nil && err2 == nil {
+				totalHours[company] += decided.Sub(entered).Hours()
+			}
 		}
 	}
-	marblesAsBytes, _:= json.Marshal(needMarbles)
-	return shim.Success(marblesAsBytes)
 
+	for i := range report {
+		if report[i].Decided > 0 {
+			report[i].AvgHours = float64(int(totalHours[report[i].Company]/float64(report[i].Decided)*100)) / 100
+		}
+	}
+	sort.Slice(report, func(i, j int) bool { return report[i].Company < report[j].Company })
+
+	reportAsBytes, _ := json.Marshal(report)
+	return shim.Success(reportAsBytes)
+}
+
+// ============================================================================================================================
+// Read Escalation Chain - get the supervisors of a company
+//
+// Inputs - Array of strings
+//     0
+//  company
+//  "bank"
+// ============================================================================================================================
+func read_escalation_chain(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+	chain, err := get_escalation_chain(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	chainAsBytes, _ := json.Marshal(chain)
+	return shim.Success(chainAsBytes)
+}
+
+// ============================================================================================================================
+// Verify Document - tell whether a file someone holds is the one registered on a marble
+//
+// The caller hashes its copy of the file (sha256) and passes the hash, no file content touches the ledger.
+//
+// Inputs - Array of strings
+//        0      ,              1
+//    marble id  ,         sha256 (hex)
+//   "m999999999", "9f86d081884c7d659a2feaa..."
+//
+// Returns:
+// {"id": "m999999999", "hash": "9f86...", "match": true, "document": {"doc_type": "invoice", ...}}
+// ============================================================================================================================
+func verify_document(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	type Verification struct {
+		Id       string    `json:"id"`
+		Hash     string    `json:"hash"`
+		Match    bool      `json:"match"`
+		Document *Document `json:"document,omitempty"`
+	}
+	var verification Verification
+
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 2")
+	}
+	if !is_sha256_hex(args[1]) {
+		return shim.Error("2nd argument must be a hex encoded sha256 hash")
+	}
+
+	marble, err := get_marble(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	verification.Id = marble.Id
+	verification.Hash = strings.ToLower(args[1])
+	for i := range marble.Documents {
+		if marble.Documents[i].Hash == verification.Hash {
+			verification.Match = true
+			verification.Document = &marble.Documents[i]
+			break
+		}
+	}
+
+	verificationAsBytes, _ := json.Marshal(verification)
+	return shim.Success(verificationAsBytes)
+}
+
+// ============================================================================================================================
+// Read Marble Private - get the private commercial terms of a marble
+//
+// Only answers on peers of organizations in the collection. "hash_matches" tells whether the private data is the
+// version the public marble points to.
+//
+// Inputs - Array of strings
+//        0
+//    marble id
+//   "m999999999"
+// ============================================================================================================================
+func read_marble_private(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	type PrivateView struct {
+		Private     MarblePrivate `json:"private"`
+		HashMatches bool          `json:"hash_matches"`
+	}
+	var view PrivateView
+
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+
+	marble, err := get_marble(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if marble.PrivateHash == "" {
+		return shim.Error("marble " + marble.Id + " has no private terms")
+	}
+	privateAsBytes, err := stub.GetPrivateData(PrivateCollection, marble.Id)
+	if err != nil || len(privateAsBytes) == 0 {
+		return shim.Error("private data of marble " + marble.Id + " is not available on this peer")
+	}
+	json.Unmarshal(privateAsBytes, &view.Private)
+	hash := sha256.Sum256(privateAsBytes)
+	view.HashMatches = hex.EncodeToString(hash[:]) == marble.PrivateHash
+
+	viewAsBytes, _ := json.Marshal(view)
+	return shim.Success(viewAsBytes)
+}
+
+// ============================================================================================================================
+// Read Org MSPs - get the company to MSP id mapping used for marble endorsement policies
+//
+// Inputs - none
+// ============================================================================================================================
+func read_org_msps(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	msps, err := get_org_msps(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	mspsAsBytes, _ := json.Marshal(msps)
+	return shim.Success(mspsAsBytes)
+}
+
+// ============================================================================================================================
+// Audit Report - every state change of marbles, owners and configuration in a time window (auditor only)
+//
+// The auditor id must be an auditor user and the invoker the auditor, by certificate role or MSP.
+//
+// Inputs - Array of strings
+//        0       ,          1            ,          2
+//   auditor id   ,         from          ,          to
+//  "o1234567"    , "2018-06-01"          , "2018-06-30 18:00:00"
+// ============================================================================================================================
+func audit_report(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	type AuditChange struct {
+		Key      string `json:"key"`
+		Type     string `json:"type"`       //marble, owner or config
+		TxId     string `json:"txId"`
+		Date     string `json:"date"`
+		IsDelete bool   `json:"is_delete"`
+		Summary  string `json:"summary"`    //where the marble stands after the change
+	}
+	type AuditReport struct {
+		From         string         `json:"from"`
+		To           string         `json:"to"`
+		Transactions int            `json:"transactions"`
+		ByType       map[string]int `json:"by_type"`
+		Changes      []AuditChange  `json:"changes"`
+	}
+
+	if len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting 3")
+	}
+	user, err := get_user(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if !is_auditor(user) {
+		return shim.Error("audit_report is for the auditor, " + user.Id + " is " + user.Company)
+	}
+	if !is_auditor_invoker(stub) {
+		return shim.Error("audit_report is for the auditor, the invoker is not the auditor")
+	}
+	from, err := parse_date(args[1], false)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	to, err := parse_date(args[2], true)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if to.Before(from) {
+		return shim.Error("to is before from")
+	}
+
+	// ---- keys to look at ---- //
+	keyTypes := map[string]string{}
+	keys, err := get_marble_ids(stub)                       //deleted marbles too
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	for _, key := range keys {
+		keyTypes[key] = "marble"
+	}
+	ownersIterator, err := stub.GetStateByRange("o0", "o9999999999999999999")
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer ownersIterator.Close()
+	for ownersIterator.HasNext() {
+		aKeyValue, err := ownersIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		keys = append(keys, aKeyValue.Key)
+		keyTypes[aKeyValue.Key] = "owner"
+	}
+	configKeys := []string{"quorum_rules", "routing_rules", "workflow", "org_msps", "admin_msp"}
+	for _, company := range Step_company {
+		configKeys = append(configKeys, "escalation_"+company)
+	}
+	for _, key := range configKeys {
+		if _, ok := keyTypes[key]; !ok {
+			keys = append(keys, key)
+			keyTypes[key] = "config"
+		}
+	}
+
+	// ---- their history in the window ---- //
+	report := AuditReport{From: from.Format(DateLayout), To: to.Format(DateLayout), ByType: map[string]int{}}
+	txs := map[string]bool{}
+	for _, key := range keys {
+		resultsIterator, err := stub.GetHistoryForKey(key)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		for resultsIterator.HasNext() {
+			historyData, err := resultsIterator.Next()
+			if err != nil {
+				resultsIterator.Close()
+				return shim.Error(err.Error())
+			}
+			ts, err := ptypes.Timestamp(historyData.Timestamp)
+			if err != nil || ts.Before(from) || ts.After(to) {
+				continue
+			}
+
+			change := AuditChange{Key: key, Type: keyTypes[key], TxId: historyData.TxId, Date: ts.UTC().Format(DateLayout), IsDelete: historyData.IsDelete}
+			if change.IsDelete {
+				change.Summary = "deleted"
+			} else if change.Type == "marble" {
+				var marble Marble
+				json.Unmarshal(historyData.Value, &marble)
+				change.Summary = marble_summary(marble)
+			} else if change.Type == "owner" {
+				var owner User
+				json.Unmarshal(historyData.Value, &owner)
+				change.Summary = owner.Company + " enabled " + strconv.FormatBool(owner.Enabled)
+			}
+			report.Changes = append(report.Changes, change)
+			report.ByType[change.Type]++
+			txs[change.TxId] = true
+		}
+		resultsIterator.Close()
+	}
+	report.Transactions = len(txs)
+	sort.SliceStable(report.Changes, func(i, j int) bool {
+		return report.Changes[i].Date < report.Changes[j].Date
+	})
+
+	reportAsBytes, _ := json.Marshal(report)
+	return shim.Success(reportAsBytes)
+}
+
+// where a marble stands, e.g. "waiting BankCheck", "disputed at BankCheck", "split" or "ended success"
+func marble_summary(marble Marble) string {
+	step := pending_step(marble)
+	if marble.Status == Split {
+		return "split"
+	}
+	if marble.Status == Disputed && len(marble.Disputes) > 0 {
+		return "disputed at " + Step_name[marble.Disputes[len(marble.Disputes)-1].Step]
+	}
+	if step >= 0 {
+		return "waiting " + Step_name[step]
+	}
+	if marble.Check[EndOf].Review == Success {
+		return "ended success"
+	}
+	if marble.Check[EndOf].Review == Failure {
+		return "ended failure"
+	}
+	return "no stage pending"
+}
+
+// ============================================================================================================================
+// Read Marble At - a marble as it was at a point in time
+//
+// Inputs - Array of strings
+//        0            ,          1
+//       id            ,          at
+//  "m1490898165086"   , "2018-03-31" (end of that day) or "2018-03-31 12:00:00"
+// ============================================================================================================================
+func read_marble_at(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 2")
+	}
+	at, err := parse_date(args[1], true)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	marble, found, err := get_marble_at(stub, args[0], at)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if !found {
+		return shim.Error("marble " + args[0] + " did not exist at " + at.Format(DateLayout))
+	}
+	err = open_marble(stub, &marble)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	marbleAsBytes, _ := json.Marshal(marble)
+	return shim.Success(marbleAsBytes)
+}
+
+// ============================================================================================================================
+// Read Portfolio At - totals of all marbles as they were at a point in time
+//
+// Totals are by stage ("waiting BankCheck", "ended success", ...) and by organization, a marble counting for every
+// company taking part in it. "financed" is what the bank had lent and not got back yet. Balances of encrypted marbles
+// need their key in the transient map, those that cannot be read are listed in "unavailable". Private balances are the
+// current ones, private data keeps no history.
+//
+// Inputs - Array of strings
+//        0         ,      1
+//        at        ,   company (optional, only the marbles it takes part in)
+//   "2018-03-31"   ,   "bank"
+// ============================================================================================================================
+func read_portfolio_at(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	type Total struct {
+		Count   int `json:"count"`
+		Balance int `json:"balance"`
+	}
+	type Portfolio struct {
+		At             string            `json:"at"`
+		Company        string            `json:"company,omitempty"`
+		Total          Total             `json:"total"`
+		Financed       Total             `json:"financed"`
+		ByStage        map[string]*Total `json:"by_stage"`
+		ByOrganization map[string]*Total `json:"by_organization"`
+		Unavailable    []string          `json:"unavailable,omitempty"`
+	}
+
+	if len(args) != 1 && len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 1 or 2")
+	}
+	at, err := parse_date(args[0], true)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	portfolio := Portfolio{At: at.Format(DateLayout), ByStage: map[string]*Total{}, ByOrganization: map[string]*Total{}}
+	if len(args) == 2 {
+		portfolio.Company = args[1]
+	}
+
+	ids, err := get_marble_ids(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	for _, id := range ids {
+		marble, found, err := get_marble_at(stub, id, at)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if !found {
+			continue
+		}
+		companies := marble_companies(marble)
+		if portfolio.Company != "" && !companies[portfolio.Company] {
+			continue
+		}
+
+		balance, err := marble_balance(stub, marble)
+		if err != nil {
+			portfolio.Unavailable = append(portfolio.Unavailable, id)
+			balance = 0
+		}
+		portfolio.Total.Count++
+		portfolio.Total.Balance += balance
+		if marble.Check[BankCheck].Review == Success && marble.Check[BankRecv].Review != Success {
+			portfolio.Financed.Count++
+			portfolio.Financed.Balance += balance
+		}
+
+		stage := marble_summary(marble)
+		if portfolio.ByStage[stage] == nil {
+			portfolio.ByStage[stage] = &Total{}
+		}
+		portfolio.ByStage[stage].Count++
+		portfolio.ByStage[stage].Balance += balance
+		for company := range companies {
+			if portfolio.ByOrganization[company] == nil {
+				portfolio.ByOrganization[company] = &Total{}
+			}
+			portfolio.ByOrganization[company].Count++
+			portfolio.ByOrganization[company].Balance += balance
+		}
+	}
+
+	portfolioAsBytes, _ := json.Marshal(portfolio)
+	return shim.Success(portfolioAsBytes)
+}
+
+// the companies taking part in a marble, the holder and every company that worked on one of its stages
+func marble_companies(marble Marble) map[string]bool {
+	companies := map[string]bool{marble.User.Company: true}
+	for _, check := range marble.Check {
+		if check.Company != "" && check.UserID != "" {
+			companies[check.Company] = true
+		}
+	}
+	return companies
+}
+
+// only the marbles of one product
+func filter_product(marbles []Marble, product string) ([]Marble, error) {
+	if product != Receivable && product != Reverse {
+		return nil, errors.New("product must be " + Receivable + " or " + Reverse)
+	}
+	var filtered []Marble
+	for _, marble := range marbles {
+		if marble_product(marble) == product {
+			filtered = append(filtered, marble)
+		}
+	}
+	return filtered, nil
 }
@@ -0,0 +1,314 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/lib/cid"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// ============================================================================================================================
+// Portfolio Stats - counts and amounts of each organization's marbles, kept in two indexes by index_marble
+//
+//   "stats~company~stage~review~currency~id"                  one entry per stage of the marble that is not Disable
+//   "cpstats~company~counterparty~state~currency~id"          one entry per other company on the marble
+//
+// state is "open", "financed" (BankCheck succeeded) or "closed" (EndOf decided). The value of an entry is the public
+// balance of the marble, or "-" when its terms are private or encrypted, so get_portfolio_stats never reads a marble.
+// ============================================================================================================================
+
+var Review_name = [4]string{"disable", "wait", "success", "failure"}
+
+// the companies a marble counts for: those of marble_companies and the banks of its syndication
+func stat_companies(marble Marble) map[string]bool {
+	companies := marble_companies(marble)
+	if marble.Syndication != nil {
+		for _, tranche := range marble.Syndication.Tranches {
+			if tranche.Status != "declined" {
+				companies[tranche.Company] = true
+			}
+		}
+	}
+	return companies
+}
+
+// open, financed or closed
+func marble_state(marble Marble) string {
+	if marble.Check[EndOf].Review != Disable {
+		return "closed"
+	}
+	if marble.Check[BankCheck].Review == Success {
+		return "financed"
+	}
+	return "open"
+}
+
+// the index entries of a marble, key to value
+func stat_entries(stub shim.ChaincodeStubInterface, marble Marble) (map[string]string, error) {
+	entries := map[string]string{}
+	value := strconv.Itoa(marble.Balance)
+	if marble.PrivateHash != "" || marble.Encrypted {
+		value = "-"
+	}
+	companies := stat_companies(marble)
+	for company := range companies {
+		for step, check := range marble.Check {
+			if check.Review <= Disable || check.Review > Failure {
+				continue
+			}
+			key, err := stub.CreateCompositeKey("stats", []string{company, Step_name[step], Review_name[check.Review], marble.Currency, marble.Id})
+			if err != nil {
+				return entries, err
+			}
+			entries[key] = value
+		}
+		for counterparty := range companies {
+			if counterparty == company {
+				continue
+			}
+			key, err := stub.CreateCompositeKey("cpstats", []string{company, counterparty, marble_state(marble), marble.Currency, marble.Id})
+			if err != nil {
+				return entries, err
+			}
+			entries[key] = value
+		}
+	}
+	return entries, nil
+}
+
+// ============================================================================================================================
+// Index Stats - replace the stats entries of old (nil when new) with those of marble (nil when deleted)
+// ============================================================================================================================
+func index_stats(stub shim.ChaincodeStubInterface, old *Marble, marble *Marble) error {
+	wanted := map[string]string{}
+	var err error
+	if marble != nil {
+		wanted, err = stat_entries(stub, *marble)
+		if err != nil {
+			return err
+		}
+	}
+	if old != nil {
+		previous, err := stat_entries(stub, *old)
+		if err != nil {
+			return err
+		}
+		for key := range previous {
+			if _, ok := wanted[key]; ok {
+				continue
+			}
+			err = stub.DelState(key)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	for key, value := range wanted {
+		err = stub.PutState(key, []byte(value))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ----- Stat Total ----- //     how many marbles and what they amount to, apart by currency when one is set
+type StatTotal struct{
+	Count      int            `json:"count"`
+	Amount     int            `json:"amount"`                //marbles without a currency
+	ByCurrency map[string]int `json:"by_currency,omitempty"`
+}
+
+func (total *StatTotal) add(currency string, amount int) {
+	total.Count++
+	if currency == "" {
+		total.Amount += amount
+		return
+	}
+	if total.ByCurrency == nil {
+		total.ByCurrency = map[string]int{}
+	}
+	total.ByCurrency[currency] += amount
+}
+
+// add to totals[group][key]
+func add_stat(totals map[string]map[string]*StatTotal, group string, key string, currency string, amount int) {
+	if totals[group] == nil {
+		totals[group] = map[string]*StatTotal{}
+	}
+	if totals[group][key] == nil {
+		totals[group][key] = &StatTotal{}
+	}
+	totals[group][key].add(currency, amount)
+}
+
+// ============================================================================================================================
+// Report Company - the organization a report is for: the one passed in args, or else the invoker's
+//
+// The invoker's MSP must be registered (see register_org_msp) to its company, and only that company can be read,
+// unless the invoker is the auditor, by the role attribute of its certificate or by the auditor MSP.
+// ============================================================================================================================
+func report_company(stub shim.ChaincodeStubInterface, args []string) (string, error) {
+	invoker, invokerErr := invoker_company(stub)
+	auditor := is_auditor_invoker(stub)
+	company := invoker
+	if len(args) > 0 && args[0] != "" {
+		company = args[0]
+	}
+	if auditor && company != "" {
+		return company, nil
+	}
+	if invokerErr != nil {
+		return "", errors.New("cannot tell the organization of the invoker, " + invokerErr.Error())
+	}
+	if company != invoker {
+		return "", errors.New("'" + invoker + "' can only read its own portfolio")
+	}
+	return company, nil
+}
+
+// is the invoker the auditor, by the role attribute of its certificate or by the auditor MSP
+func is_auditor_invoker(stub shim.ChaincodeStubInterface) bool {
+	role, found, _ := cid.GetAttributeValue(stub, "role")
+	if found && role == AuditorCompany {
+		return true
+	}
+	invoker, err := invoker_company(stub)
+	return err == nil && invoker == AuditorCompany
+}
+
+// the company the invoker belongs to, from the MSPs registered with register_org_msp
+func invoker_company(stub shim.ChaincodeStubInterface) (string, error) {
+	msp, err := get_invoker_msp(stub)
+	if err != nil {
+		return "", err
+	}
+	msps, err := get_org_msps(stub)
+	if err != nil {
+		return "", err
+	}
+	for company, companyMsp := range msps {
+		if companyMsp == msp {
+			return company, nil
+		}
+	}
+	return "", errors.New("no company registered MSP " + msp)
+}
+
+// ============================================================================================================================
+// Get Portfolio Stats - how many marbles of an organization are at each stage and what they amount to
+//
+// by_stage counts marbles by stage and review ("BankCheck" -> "wait"), by_counterparty by the other organization and
+// state. "financed" is what the bank has lent and not got back yet. Amounts are in the marble currency, those with
+// a currency set are summed by currency apart. Marbles with private terms are only counted, in "undisclosed".
+// Without a company the invoker's organization is used; other organizations can only be read by the auditor.
+//
+// Inputs - Array of strings
+//         0
+//   company (optional)
+//     "bank"
+// ============================================================================================================================
+func get_portfolio_stats(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	type Stats struct {
+		Company        string                           `json:"company"`
+		ByStage        map[string]map[string]*StatTotal `json:"by_stage"`
+		ByCounterparty map[string]map[string]*StatTotal `json:"by_counterparty"`
+		Financed       StatTotal                        `json:"financed"`
+		Undisclosed    int                              `json:"undisclosed"`
+	}
+
+	if len(args) > 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 0 or 1")
+	}
+	company, err := report_company(stub, args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	stats := Stats{Company: company, ByStage: map[string]map[string]*StatTotal{}, ByCounterparty: map[string]map[string]*StatTotal{}}
+	undisclosed := map[string]bool{}
+	financed := map[string]string{}       //marble id -> currency, BankCheck succeeded
+	repaid := map[string]bool{}
+	amounts := map[string]int{}
+
+	resultsIterator, err := stub.GetStateByPartialCompositeKey("stats", []string{company})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer resultsIterator.Close()
+	for resultsIterator.HasNext() {
+		aKeyValue, err := resultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		_, keyParts, err := stub.SplitCompositeKey(aKeyValue.Key)
+		if err != nil || len(keyParts) != 5 {
+			continue
+		}
+		stage, review, currency, id := keyParts[1], keyParts[2], keyParts[3], keyParts[4]
+		value := string(aKeyValue.Value)
+		if value == "-" {
+			undisclosed[id] = true
+		}
+		amount, _ := strconv.Atoi(value)
+		add_stat(stats.ByStage, stage, review, currency, amount)
+		amounts[id] = amount
+		if stage == Step_name[BankCheck] && review == Review_name[Success] {
+			financed[id] = currency
+		}
+		if stage == Step_name[BankRecv] && review == Review_name[Success] {
+			repaid[id] = true
+		}
+	}
+	for id, currency := range financed {
+		if repaid[id] {
+			continue
+		}
+		stats.Financed.add(currency, amounts[id])
+	}
+	stats.Undisclosed = len(undisclosed)
+
+	cpIterator, err := stub.GetStateByPartialCompositeKey("cpstats", []string{company})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer cpIterator.Close()
+	for cpIterator.HasNext() {
+		aKeyValue, err := cpIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		_, keyParts, err := stub.SplitCompositeKey(aKeyValue.Key)
+		if err != nil || len(keyParts) != 5 {
+			continue
+		}
+		amount, _ := strconv.Atoi(string(aKeyValue.Value))
+		add_stat(stats.ByCounterparty, keyParts[1], keyParts[2], keyParts[3], amount)
+	}
+
+	statsAsBytes, _ := json.Marshal(stats)
+	return shim.Success(statsAsBytes)
+}
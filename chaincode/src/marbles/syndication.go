@@ -0,0 +1,301 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// ============================================================================================================================
+// Syndication - several banks sharing the financing of one marble
+//
+// The lead bank (Step_company[BankCheck]) invites participant banks with a share in basis points while the marble
+// waits for BankCheck, and keeps what is left itself. Each participant approves or declines its tranche, a declined
+// share goes back to the lead. BankCheck can only succeed once no tranche is waiting, then the financed amount is
+// allocated pro-rata, and again the repayment at BankRecv. Rounding remainders go to the lead, the first tranche.
+// The tranche amounts add up to the balance and are public, so private and encrypted marbles cannot be syndicated.
+// ============================================================================================================================
+
+// is this a bank that can join a syndication
+func is_bank(user User) bool {
+	switch user.Company {
+	case Step_company[New], Step_company[CompanyCheck], Step_company[RiskCheck], AuditorCompany, RatePublisherCompany:
+		return false
+	}
+	return user.Company != ""
+}
+
+// split total over the tranches by share, declined tranches get nothing, the lead gets the remainder
+func allocate_pro_rata(total int, tranches []Tranche) []int {
+	amounts := make([]int, len(tranches))
+	allocated := 0
+	for i, tranche := range tranches {
+		if i == 0 || tranche.Status != "approved" {
+			continue
+		}
+		amount := new(big.Int).Mul(big.NewInt(int64(total)), big.NewInt(int64(tranche.ShareBps)))
+		amounts[i] = int(amount.Quo(amount, big.NewInt(10000)).Int64())
+		allocated += amounts[i]
+	}
+	if len(amounts) > 0 {
+		amounts[0] = total - allocated
+	}
+	return amounts
+}
+
+// ============================================================================================================================
+// Syndicate Stage - called by review_one when a bank stage succeeds
+//
+// BankCheck: every tranche must be answered, the financing is allocated. BankRecv: the repayment is allocated.
+// Amounts are in the loan currency.
+// ============================================================================================================================
+func syndicate_stage(stub shim.ChaincodeStubInterface, marble *Marble, step int) error {
+	if marble.Syndication == nil || (step != BankCheck && step != BankRecv) {
+		return nil
+	}
+	if marble.PrivateHash != "" || marble.Encrypted {
+		return errors.New("marble " + marble.Id + " keeps its balance off the ledger and cannot be syndicated")
+	}
+	tranches := marble.Syndication.Tranches
+	if step == BankCheck {
+		for _, tranche := range tranches {
+			if tranche.Status == "invited" {
+				return errors.New("tranche of " + tranche.Bank + " is not approved yet")
+			}
+		}
+	}
+	balance, err := loan_amount(stub, *marble, step)
+	if err != nil {
+		return err
+	}
+	for i, amount := range allocate_pro_rata(balance, tranches) {
+		if step == BankCheck {
+			tranches[i].Amount = amount
+		} else {
+			tranches[i].Repaid = amount
+		}
+	}
+	return nil
+}
+
+// ============================================================================================================================
+// Invite Participant - the lead bank offers a share of the financing to another bank
+//
+// The bank user who sends the first invitation leads the syndication, later invitations must come from that user.
+//
+// Inputs - Array of strings
+//        0      ,    1     ,        2         ,      3
+//    marble id  , lead id  , participant id   ,  share_bps
+//  "m999999999" , "o3333"  ,    "o5555"       ,   "3000"      (30%)
+// ============================================================================================================================
+func invite_participant(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	fmt.Println("starting invite_participant")
+
+	if len(args) != 4 {
+		return shim.Error("Incorrect number of arguments. Expecting 4")
+	}
+	marble, lead, err := get_syndication_party(stub, args[0], args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if lead.Company != Step_company[BankCheck] {
+		return shim.Error("only the lead bank '" + Step_company[BankCheck] + "' can invite participants")
+	}
+	if marble.Syndication != nil && lead.Id != marble.Syndication.Lead {
+		return shim.Error("only user :" + marble.Syndication.Lead + ", who leads the syndication, can invite participants")
+	}
+	if marble.PrivateHash != "" || marble.Encrypted {
+		return shim.Error("marble " + marble.Id + " keeps its balance off the ledger and cannot be syndicated")
+	}
+	if marble.Check[BankCheck].Review != Wait {
+		return shim.Error("participants can only be invited while the marble waits for " + Step_name[BankCheck])
+	}
+	participant, err := get_user(stub, args[2])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if !participant.Enabled || !is_bank(participant) || participant.Company == lead.Company {
+		return shim.Error("user :" + participant.Id + " is not a bank that can join the syndication")
+	}
+	share, err := strconv.Atoi(args[3])
+	if err != nil || share <= 0 {
+		return shim.Error("4th argument must be a positive share in basis points")
+	}
+
+	date, err := get_tx_date(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if marble.Syndication == nil {
+		marble.Syndication = &Syndication{Lead: lead.Id, Tranches: []Tranche{{Bank: lead.Id, Company: lead.Company, ShareBps: 10000, Status: "approved", Date: date}}}
+	}
+	tranches := marble.Syndication.Tranches
+	for i, tranche := range tranches {
+		if tranche.Company == participant.Company && tranche.Status != "declined" {
+			return shim.Error("'" + participant.Company + "' already takes part in the syndication")
+		}
+		if i > 0 && tranche.Status == "declined" && tranche.Bank == participant.Id {
+			return shim.Error("user :" + participant.Id + " declined, invite another bank")
+		}
+	}
+	if share >= tranches[0].ShareBps {
+		return shim.Error("the lead bank only has " + strconv.Itoa(tranches[0].ShareBps) + " bps left, it must keep some")
+	}
+	tranches[0].ShareBps -= share
+	marble.Syndication.Tranches = append(tranches, Tranche{Bank: participant.Id, Company: participant.Company, ShareBps: share, Status: "invited", Date: date})
+
+	jsonAsBytes, err := put_marble(stub, marble)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	fmt.Println("- end invite_participant")
+	return shim.Success(jsonAsBytes)
+}
+
+// ============================================================================================================================
+// Approve Tranche - a participant bank approves or declines its share of the financing
+//
+// Inputs - Array of strings
+//        0      ,       1        ,          2            ,     3
+//    marble id  , participant id , 2 (approve) 3 (decline), comment
+//  "m999999999" ,    "o5555"     ,          "2"          ,   "ok"
+// ============================================================================================================================
+func approve_tranche(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	fmt.Println("starting approve_tranche")
+
+	if len(args) != 4 {
+		return shim.Error("Incorrect number of arguments. Expecting 4")
+	}
+	marble, user, err := get_syndication_party(stub, args[0], args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	state, err := strconv.Atoi(args[2])
+	if err != nil || (state != Success && state != Failure) {
+		return shim.Error("3rd argument must be 2 (approve) or 3 (decline)")
+	}
+	if marble.Check[BankCheck].Review != Wait {
+		return shim.Error("tranches can only be answered while the marble waits for " + Step_name[BankCheck])
+	}
+
+	var tranche *Tranche
+	if marble.Syndication != nil {
+		for i := 1; i < len(marble.Syndication.Tranches); i++ {
+			if marble.Syndication.Tranches[i].Bank == user.Id && marble.Syndication.Tranches[i].Status == "invited" {
+				tranche = &marble.Syndication.Tranches[i]
+			}
+		}
+	}
+	if tranche == nil {
+		return shim.Error("user :" + user.Id + " has no tranche waiting on marble " + marble.Id)
+	}
+
+	date, err := get_tx_date(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	tranche.Date = date
+	tranche.Comment = args[3]
+	if state == Success {
+		tranche.Status = "approved"
+	} else {
+		tranche.Status = "declined"
+		marble.Syndication.Tranches[0].ShareBps += tranche.ShareBps   //back to the lead
+		tranche.ShareBps = 0
+	}
+
+	jsonAsBytes, err := put_marble(stub, marble)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	fmt.Println("- end approve_tranche")
+	return shim.Success(jsonAsBytes)
+}
+
+// ============================================================================================================================
+// Get Syndication - the tranches of a marble, with the amount each bank finances when it is not financed yet
+//
+// Inputs - Array of strings
+//        0
+//    marble id
+//  "m999999999"
+// ============================================================================================================================
+func get_syndication(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	type SyndicationView struct {
+		Id          string      `json:"id"`
+		Balance     int         `json:"balance"`
+		Financed    bool        `json:"financed"`
+		Repaid      bool        `json:"repaid"`
+		Syndication Syndication `json:"syndication"`
+	}
+
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+	marble, err := get_marble(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if marble.Syndication == nil {
+		return shim.Error("marble " + marble.Id + " is financed by a single bank")
+	}
+	view := SyndicationView{Id: marble.Id, Syndication: *marble.Syndication}
+	view.Financed = marble.Check[BankCheck].Review == Success
+	view.Repaid = marble.Check[BankRecv].Review == Success
+	view.Balance, err = marble_balance(stub, marble)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if !view.Financed {
+		tranches := append([]Tranche{}, view.Syndication.Tranches...)
+		for i, amount := range allocate_pro_rata(view.Balance, tranches) {
+			tranches[i].Amount = amount                  //what each bank would finance now
+		}
+		view.Syndication.Tranches = tranches
+	}
+
+	viewAsBytes, _ := json.Marshal(view)
+	return shim.Success(viewAsBytes)
+}
+
+// the marble and an enabled user acting on its syndication
+func get_syndication_party(stub shim.ChaincodeStubInterface, marbleId string, userID string) (Marble, User, error) {
+	user, err := get_user(stub, userID)
+	if err != nil {
+		return Marble{}, user, err
+	}
+	if !user.Enabled {
+		return Marble{}, user, errors.New("user :" + userID + " is disabled")
+	}
+	marble, err := get_marble(stub, marbleId)
+	if err != nil {
+		return marble, user, err
+	}
+	err = check_marble_active(marble)
+	return marble, user, err
+}
@@ -0,0 +1,62 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package main
+
+import "testing"
+
+func TestAllocateProRata(t *testing.T) {
+	tranches := []Tranche{
+		{Bank: "o3", ShareBps: 5000, Status: "approved"},
+		{Bank: "o7", ShareBps: 3000, Status: "approved"},
+		{Bank: "o8", ShareBps: 2000, Status: "approved"},
+	}
+	declined := []Tranche{
+		{Bank: "o3", ShareBps: 7000, Status: "approved"},
+		{Bank: "o7", ShareBps: 3000, Status: "approved"},
+		{Bank: "o8", ShareBps: 0, Status: "declined"},
+	}
+	tests := []struct {
+		name     string
+		total    int
+		tranches []Tranche
+		amounts  []int
+	}{
+		{"even", 1000, tranches, []int{500, 300, 200}},
+		{"remainder to the lead", 1001, tranches, []int{501, 300, 200}},
+		{"small total", 3, tranches, []int{3, 0, 0}},
+		{"declined gets nothing", 1001, declined, []int{701, 300, 0}},
+		{"lead alone", 1001, tranches[:1], []int{1001}},
+		{"nothing", 0, tranches, []int{0, 0, 0}},
+		{"large total", 1 << 60, tranches, []int{1<<60 - (1<<60)*3000/10000 - (1<<60)*2000/10000, (1 << 60) * 3000 / 10000, (1 << 60) * 2000 / 10000}},
+	}
+	for _, test := range tests {
+		amounts := allocate_pro_rata(test.total, test.tranches)
+		sum := 0
+		for i, amount := range amounts {
+			sum += amount
+			if i < len(test.amounts) && amount != test.amounts[i] {
+				t.Errorf("%s: tranche %d gets %d, want %d", test.name, i, amount, test.amounts[i])
+			}
+		}
+		if sum != test.total {
+			t.Errorf("%s: allocated %d of %d", test.name, sum, test.total)
+		}
+	}
+}
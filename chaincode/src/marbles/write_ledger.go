@@ -21,13 +21,14 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/hyperledger/fabric/core/chaincode/shim"
 	pb "github.com/hyperledger/fabric/protos/peer"
-	"time"
 )
 
 var firstStart int
@@ -106,7 +107,17 @@ func delete_marble(stub shim.ChaincodeStubInterface, args []string) (pb.Response
 		return shim.Error("The company '" + authed_by_company + "' cannot authorize deletion for '" + marble.User.Company + "'.")
 	}
 
+	// a disputed marble is evidence, keep it
+	err = check_marble_active(marble)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
 	// remove the marble
+	err = index_marble(stub, id, nil)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
 	err = stub.DelState(id)                                                 //remove the key from chaincode state
 	if err != nil {
 		return shim.Error("Failed to delete state")
@@ -252,15 +263,21 @@ func disable_owner(stub shim.ChaincodeStubInterface, args []string) pb.Response
 }
 
 //新建一个申请()
-//      0      ,      1  ,           2  ,     3                4        ,           5,
-//     id      ,    contact,      balance,   title           user    ,             company,
-// "m999999999", "13188888888",     "35",    "title"       "o9999999999999",        "inter",
+//      0      ,      1  ,           2  ,     3                4        ,           5,        6 (可选)
+//     id      ,    contact,      balance,   title           user    ,             company,    due date
+// "m999999999", "13188888888",     "35",    "title"       "o9999999999999",        "inter",  "2018-09-30"
+//
+// 到期日是核心企业付款的日期, 核心企业提前付款(offer_discount)时需要
+// 商业条款保密时, balance传"0", 金额和利率放在transient map的"marble_private"中:
+//   {"balance": 35, "interest_rate_bps": 450}
+// 同时在"marble_salt"中传至少16字节的随机数, 防止公开的private_hash被穷举
+// 没有私有数据集合时, 可在transient map的"marble_key"中传32字节AES密钥, contact、balance、comment加密后保存
 func init_marble(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 	var err error
 	fmt.Println("starting init_marble")
 
-	if len(args) != 6 {
-		return shim.Error("Incorrect number of arguments. Expecting 6")
+	if len(args) != 6 && len(args) != 7 {
+		return shim.Error("Incorrect number of arguments. Expecting 6 or 7")
 	}
 
 	//input sanitation
@@ -269,6 +286,13 @@ func init_marble(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 		return shim.Error(err.Error())
 	}
 
+	dueDate := ""
+	if len(args) == 7 {
+		dueDate, err = parse_due_date(args[6])
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
 	id := args[0]
 	contact := args[1]
 	balance, err := strconv.Atoi(args[2])
@@ -280,62 +304,125 @@ func init_marble(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 		return shim.Error("3rd argument must be a numeric string")
 	}
 
+	//commercial terms passed privately never appear in the public args
+	private, isPrivate, err := get_private_input(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if isPrivate {
+		if balance != 0 {
+			return shim.Error("3rd argument must be 0 when the balance is passed in the transient map")
+		}
+		balance = private.Balance
+	}
+	key, isEncrypted, err := get_marble_key(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if isPrivate && isEncrypted {
+		return shim.Error("pass either marble_private or marble_key, not both")
+	}
+
+	date, err := get_tx_date(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	var privateTerms *MarblePrivate
+	if isPrivate {
+		privateTerms = &private
+	}
+	marble, err := build_marble(stub, id, contact, balance, title, user_id, authed_by_company, date, privateTerms, key)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	marble.DueDate = dueDate
+
+	jsonAsBytes, err := put_marble(stub, marble)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	fmt.Println("- end init_marble")
+	return shim.Success(jsonAsBytes)
+}
+
+// ============================================================================================================================
+// Build Marble - check an application and make its marble, ready for put_marble
+//
+// Shared by init_marble and init_marbles_batch. private holds the commercial terms kept in PrivateCollection (nil for
+// none), key the AES key to encrypt the marble with (nil for none).
+// ============================================================================================================================
+func build_marble(stub shim.ChaincodeStubInterface, id string, contact string, balance int, title string, user_id string, authed_by_company string, date string, private *MarblePrivate, key []byte) (Marble, error) {
+	var marble Marble
+
 	//check if new user exists
 	user, err := get_user(stub, user_id)
 	if err != nil {
 		fmt.Println("Failed to find user - " + user_id)
-		return shim.Error(err.Error())
+		return marble, err
 	}
 
 	//check authorizing company (see note in set_user() about how this is quirky)
 	if user.Company != authed_by_company{
-		return shim.Error("The company '" + authed_by_company + "' cannot authorize creation for '" + user.Company + "'.")
+		return marble, errors.New("The company '" + authed_by_company + "' cannot authorize creation for '" + user.Company + "'.")
 	}
 
 	//check if marble id already exists
-	v, err := get_marble(stub, id)
+	_, err = get_marble(stub, id)
 	if err == nil {
 		fmt.Println("This marble already exists - " + id)
-		fmt.Println(v)
-		return shim.Error("This marble already exists - " + id)  //all stop a marble by this id exists
+		return marble, errors.New("This marble already exists - " + id)  //all stop a marble by this id exists
 	}
 
-	var marble Marble
-	companyUser,err:=getUserByCompany(stub,Step_company[CompanyCheck]);if err !=nil{
-		return shim.Error("there is no  core-enterprise ,can't create a transaction")
-	}
 	marble.ObjectType = "marble"
 	marble.Id = id
 	marble.Contact = contact
 	marble.Balance = balance
 	marble.Title = title
+	marble.Product = Receivable
 	marble.User.Id = user_id
 	marble.User.Username = user.Username
 	marble.User.Company = user.Company
 	marble.Check[New].UserID = user_id
 	marble.Check[New].Company = user.Company
 	marble.Check[New].Review=Success
-	marble.Check[New].Date = time.Now().Format("2006-01-02 15:04:05")
+	marble.Check[New].Date = date
 	marble.Check[New].Comment = "new  transaction"
-	marble.Check[CompanyCheck].UserID = companyUser.Id
-	marble.Check[CompanyCheck].Company = Step_company[CompanyCheck]
-	marble.Check[CompanyCheck].Review = Wait
-	marble.Check[CompanyCheck].Comment = ""
-	for i:=2;i< StepNum;i++{
+	for i:=1;i< StepNum;i++{
 		marble.Check[i].UserID=""
 		marble.Check[i].Company   = ""
 		marble.Check[i].Review = Disable
 		marble.Check[i].Comment = ""
 	}
 
-	jsonAsBytes, _ := json.Marshal(marble)         //convert to array of bytes
-	//fmt.Println(jsonAsBytes)
-	err = stub.PutState(id, jsonAsBytes)     //rewrite the owner
+	//第一个审核阶段由路由规则决定, 默认为核心企业审核
+	first, err := route_marble(stub, &marble, New)
 	if err != nil {
-		return shim.Error(err.Error())
+		return marble, err
 	}
-	fmt.Println("- end init_marble")
-	return shim.Success(jsonAsBytes)
+	if first == EndOf {
+		return marble, errors.New("the route of this marble has no review stage")
+	}
+	companyUser,err:=getStageUser(stub,marble,first);if err !=nil{
+		return marble, errors.New("there is no  "+Step_company[first]+" ,can't create a transaction")
+	}
+	err = enter_stage(stub, &marble, first, companyUser.Id, Step_company[first], date)
+	if err != nil {
+		return marble, err
+	}
+	if private != nil {
+		err = put_marble_private(stub, &marble, *private)
+		if err != nil {
+			return marble, err
+		}
+	}
+	if key != nil {
+		err = encrypt_marble(stub, &marble, key)
+		if err != nil {
+			return marble, err
+		}
+	}
+	return marble, nil
 }
 
 //  操作:如果通过提交到下一环节进行复审，如果不通过则返回上一环节
@@ -384,6 +471,10 @@ func  tx_marble(stub shim.ChaincodeStubInterface, args []string) pb.Response{
 	if err != nil{
 		return shim.Error("invalid marble id:"+marbleId)
 	}
+	err = check_marble_active(marble)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
 
 	if marble.Check[step].UserID != userID{
 		return shim.Error("user :"+userID+"no competence to review this marble")
@@ -393,22 +484,52 @@ func  tx_marble(stub shim.ChaincodeStubInterface, args []string) pb.Response{
 		fmt.Println("本次交易 未处于等待处理状态 :",marble.Check[step].Review)
 		return shim.Error("invalid,the marble is not waiting state"+strconv.Itoa(marble.Check[step].Review))
 	}
+	if len(marble.Check[step].Reviewers) > 0 {
+		return shim.Error("this stage needs quorum approvals, use review_marble")
+	}
+	date, err := get_tx_date(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	commont, err = keep_bank_comment(stub, &marble, step, user, commont, date)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	commont, err = seal_comment(stub, marble, commont)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
 	if state == Success{  //成功
 		//marble.Check[step].UserID = userID
 		marble.Check[step].Company = user.Company
 		marble.Check[step].Review = Success
-		marble.Check[step].Date = time.Now().Format("2006-01-02 15:04:05")
+		marble.Check[step].Date = date
 		marble.Check[step].Comment = commont
-		if next != ""{
-			marble.Check[step+1].UserID = next
-		}else{
-			marble.Check[step+1].UserID = userID
+		err = fx_stage(stub, &marble, step)
+		if err != nil {
+			return shim.Error(err.Error())
 		}
-
-		marble.Check[step+1].Review = Wait
-		if step == BankRecv{ //如果是银行确认收款成功，设置最后结束的状态
+		err = syndicate_stage(stub, &marble, step)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		nextStep, err := route_marble(stub, &marble, step)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if next == ""{
+			next = userID
+		}
+		if Step_company[nextStep] == Step_company[New] {  //供应商的阶段只能由持有人处理
+			next = marble.User.Id
+		}
+		err = enter_stage(stub, &marble, nextStep, next, marble.Check[nextStep].Company, date)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if nextStep == EndOf{ //如果是最后一个阶段成功，设置最后结束的状态
 			marble.Check[EndOf].Review = Success
-			marble.Check[EndOf].Date = time.Now().Format("2006-01-02 15:04:05")
+			marble.Check[EndOf].Date = date
 			marble.Check[EndOf].Comment = "the transaction is end success"
 			marble.Check[EndOf].Company = user.Company
 		}
@@ -418,19 +539,18 @@ func  tx_marble(stub shim.ChaincodeStubInterface, args []string) pb.Response{
 		//marble.Check[step].UserID = userID
 		marble.Check[step].Company = user.Company
 		marble.Check[step].Review = Failure
-		marble.Check[step].Date = time.Now().Format("2006-01-02 15:04:05")
+		marble.Check[step].Date = date
 		marble.Check[step].Comment = commont
 		marble.Check[EndOf].Review = Failure
 		marble.Check[EndOf].UserID = userID
 		marble.Check[EndOf].Company = user.Company
 		marble.Check[EndOf].Comment="the transaction is end failure"
-		marble.Check[EndOf].Date = time.Now().Format("2006-01-02 15:04:05")
+		marble.Check[EndOf].Date = date
 	}else {
 		return shim.Error("the transaction state is wrong")
 	}
 
-	jsonAsBytes, _ := json.Marshal(marble)         //convert to array of bytes
-	err = stub.PutState(marbleId, jsonAsBytes)     //rewrite the owner
+	_, err = put_marble(stub, marble)
 	if err != nil {
 		return shim.Error(err.Error())
 	}
@@ -445,11 +565,14 @@ func  tx_marble(stub shim.ChaincodeStubInterface, args []string) pb.Response{
 //  "09999999999"    "011111"    ， "2/3(success/failure)"        "comment"
 //
 func  review_marble(stub shim.ChaincodeStubInterface, args []string) pb.Response{
-	userC,_:= getUserByCompany(stub,args[1])
-	args[1]=userC.Id
 	fmt.Println("starting submit_marble")
 	if len(args) != 4 {
-		return shim.Error("Incorrect number of arguments. Expecting 5")
+		return shim.Error("Incorrect number of arguments. Expecting 4")
+	}
+	//args[1] 可以是userid(会签阶段需要区分同一公司的多个审核人)，也可以是公司名
+	if _, err := get_user(stub, args[1]); err != nil {
+		userC,_:= getUserByCompany(stub,args[1])
+		args[1]=userC.Id
 	}
 
 	//input sanitation
@@ -463,8 +586,6 @@ func  review_marble(stub shim.ChaincodeStubInterface, args []string) pb.Response
 	state,err :=strconv.Atoi(args[2])
 	commont := args[3]
 
-	var step int
-	var next User
 	user, err := get_user(stub, userID)
 	if err != nil {
 		fmt.Println("Failed to find user - " + userID)
@@ -480,42 +601,107 @@ func  review_marble(stub shim.ChaincodeStubInterface, args []string) pb.Response
 //		fmt.Println("当前步骤无效")
 //		return shim.Error(err.Error())
 //	}
+	date, err := get_tx_date(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	marble, err := review_one(stub, marbleId, user, state, commont, date)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	_, err = put_marble(stub, marble)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(nil)
+}
+
+// ============================================================================================================================
+// Review One - apply a review of the user to the stage a marble is waiting for, ready for put_marble
+//
+// Shared by review_marble and review_marbles_batch, the marble is returned but not written.
+// ============================================================================================================================
+func review_one(stub shim.ChaincodeStubInterface, marbleId string, user User, state int, commont string, date string) (Marble, error) {
+	var step int
+	var next User
 	marble,err:= getMarblesById(stub,marbleId)
 	if err != nil{
-		return shim.Error("invalid marble id:"+marbleId)
+		return marble, errors.New("invalid marble id:"+marbleId)
+	}
+	err = check_marble_active(marble)
+	if err != nil {
+		return marble, err
 	}
-	for i:=1;i<StepNum;i++{
+	for i:=0;i<StepNum;i++{              //反向保理的New(供应商确认)也在这里审核
 		if marble.Check[i].Review == Wait{
 			step = i
 			if user.Company != Step_company[step]{
-				return shim.Error("you don't have the permissions to this step")
-			}
-			 next,err = getUserByCompany(stub,Step_company[step+1]);if err != nil{
-				return shim.Error("can not get the next step user !!")
+				return marble, errors.New("you don't have the permissions to this step")
 			}
 			break
 		}
 	}
 
-	if marble.Check[step].UserID != userID{
-		return shim.Error("user :"+userID+"no competence to review this marble")
+	if marble.Check[step].Review != Wait{
+		return marble, errors.New("invalid,the marble is not waiting state="+strconv.Itoa(marble.Check[step].Review))
 	}
 
-	if marble.Check[step].Review != Wait{
-		return shim.Error("invalid,the marble is not waiting state="+strconv.Itoa(marble.Check[step].Review))
+	//银行的审核意见在商业条款保密时放入私有数据
+	commont, err = keep_bank_comment(stub, &marble, step, user, commont, date)
+	if err != nil {
+		return marble, err
+	}
+	commont, err = seal_comment(stub, marble, commont)
+	if err != nil {
+		return marble, err
 	}
+
+	if len(marble.Check[step].Reviewers) > 0 {
+		//会签阶段: 记录每个人的签署, 达到法定人数才进入下一环节
+		state, err = sign_stage(&marble, step, user, state, commont, date)
+		if err != nil {
+			return marble, err
+		}
+		if state == Wait {
+			return marble, nil
+		}
+	} else if marble.Check[step].UserID != user.Id{
+		return marble, errors.New("user :"+user.Id+"no competence to review this marble")
+	}
+
 	if state == Success{  //成功
 		//marble.Check[step].UserID = userID
 		marble.Check[step].Company = user.Company
 		marble.Check[step].Review = Success
-		marble.Check[step].Date = time.Now().Format("2006-01-02 15:04:05")
+		marble.Check[step].Date = date
 		marble.Check[step].Comment = commont
-		marble.Check[step+1].UserID = next.Id
-		marble.Check[step+1].Review = Wait
-		marble.Check[step+1].Company= next.Company
-		if step == BankRecv{ //如果是银行确认收款成功，设置最后结束的状态
+		//跨币种时按当时生效的汇率换算, 记录所用汇率
+		err = fx_stage(stub, &marble, step)
+		if err != nil {
+			return marble, err
+		}
+		//银团放款: 所有参与行确认后才能放款, 放款和收款按份额分配
+		err = syndicate_stage(stub, &marble, step)
+		if err != nil {
+			return marble, err
+		}
+		//下一阶段由路由规则决定
+		nextStep, err := route_marble(stub, &marble, step)
+		if err != nil {
+			return marble, err
+		}
+		next,err = getStageUser(stub,marble,nextStep);if err != nil{
+			return marble, errors.New("can not get the next step user !!")
+		}
+		err = enter_stage(stub, &marble, nextStep, next.Id, next.Company, date)
+		if err != nil {
+			return marble, err
+		}
+		if nextStep == EndOf{ //如果是最后一个阶段成功，设置最后结束的状态
 			marble.Check[EndOf].Review = Success
-			marble.Check[EndOf].Date = time.Now().Format("2006-01-02 15:04:05")
+			marble.Check[EndOf].Date = date
 			marble.Check[EndOf].Comment = "the transaction is end success !"
 		}
 
@@ -523,22 +709,1462 @@ func  review_marble(stub shim.ChaincodeStubInterface, args []string) pb.Response
 		//marble.Check[step].UserID = userID
 		marble.Check[step].Company = user.Company
 		marble.Check[step].Review = Failure
-		marble.Check[step].Date = time.Now().Format("2006-01-02 15:04:05")
+		marble.Check[step].Date = date
 		marble.Check[step].Comment = commont
 		marble.Check[EndOf].Review = Failure
-		marble.Check[EndOf].UserID = userID
+		marble.Check[EndOf].UserID = user.Id
 		marble.Check[EndOf].Company = user.Company
 		marble.Check[EndOf].Comment="the transaction is end failure !"
-		marble.Check[EndOf].Date = time.Now().Format("2006-01-02 15:04:05")
+		marble.Check[EndOf].Date = date
 	}else {
-		return shim.Error("the marbles state is wrong")
+		return marble, errors.New("the marbles state is wrong")
+	}
+
+	return marble, nil
+}
+
+
+// ============================================================================================================================
+// Set Quorum Rule - require N-of-M approvals from a reviewer set at one stage
+//
+// The rule applies to marbles entering the stage with balance >= min_balance (the highest matching min_balance wins),
+// e.g. two of three credit officers for bank checks above 1000000. A quorum of 0 removes the rule.
+//
+// Inputs - Array of Strings
+//     0   ,      1      ,    2    ,            3             ,        4
+//   step  , min_balance ,  quorum ,  reviewer ids (comma sep) , authed_by_company
+//   "2"   ,  "1000000"  ,   "2"   ,  "o111,o222,o333"         ,      "bank"
+// ============================================================================================================================
+func set_quorum_rule(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var err error
+	fmt.Println("starting set_quorum_rule")
+
+	if len(args) != 5 {
+		return shim.Error("Incorrect number of arguments. Expecting 5")
+	}
+
+	//input sanitation, the reviewer list may be longer than 32 characters
+	err = sanitize_arguments([]string{args[0], args[1], args[2], args[4]})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	step, err := strconv.Atoi(args[0])
+	if err != nil || !is_review_step(step) {
+		return shim.Error("1st argument must be a reviewing step")
+	}
+	minBalance, err := strconv.Atoi(args[1])
+	if err != nil || minBalance < 0 {
+		return shim.Error("2nd argument must be a non-negative numeric string")
+	}
+	quorum, err := strconv.Atoi(args[2])
+	if err != nil || quorum < 0 {
+		return shim.Error("3rd argument must be a non-negative numeric string")
+	}
+	authed_by_company := args[4]
+
+	//only the company owning the step may decide how it is reviewed
+	if authed_by_company != Step_company[step] {
+		return shim.Error("The company '" + authed_by_company + "' cannot set the quorum of step " + args[0])
+	}
+
+	var reviewers []string
+	if quorum > 0 {
+		for _, id := range strings.Split(args[3], ",") {
+			id = strings.TrimSpace(id)
+			if len(id) == 0 {
+				continue
+			}
+			user, err := get_user(stub, id)
+			if err != nil {
+				return shim.Error(err.Error())
+			}
+			if !user.Enabled || user.Company != Step_company[step] {
+				return shim.Error("user :" + id + " cannot review step " + args[0])
+			}
+			for _, r := range reviewers {
+				if r == id {
+					return shim.Error("duplicate reviewer - " + id)
+				}
+			}
+			reviewers = append(reviewers, id)
+		}
+		if quorum > len(reviewers) {
+			return shim.Error("quorum " + args[2] + " is larger than the reviewer set")
+		}
+	}
+
+	rules, err := get_quorum_rules(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	//replace the rule of the same step and min_balance
+	var newRules []QuorumRule
+	for _, rule := range rules {
+		if rule.Step != step || rule.MinBalance != minBalance {
+			newRules = append(newRules, rule)
+		}
+	}
+	if quorum > 0 {
+		var rule QuorumRule
+		rule.Step = step
+		rule.MinBalance = minBalance
+		rule.Quorum = quorum
+		rule.Reviewers = reviewers
+		newRules = append(newRules, rule)
+	}
+
+	jsonAsBytes, _ := json.Marshal(newRules)
+	err = stub.PutState("quorum_rules", jsonAsBytes)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("- end set_quorum_rule")
+	return shim.Success(jsonAsBytes)
+}
+
+
+// ============================================================================================================================
+// Set Routing Rule - add or replace an amount based routing rule
+//
+// Rules are applied in stored order to Default_route whenever a marble is created or moves to its next stage.
+// A rule matches when min_balance <= balance < max_balance, a max_balance of 0 means no upper bound.
+//   "add"  - insert step right after the stage "after", e.g. a risk committee check after the bank check
+//   "skip" - leave step out of the route, e.g. no core enterprise re-confirmation for small amounts
+//
+// Inputs - Array of Strings
+//       0      ,      1      ,      2      ,    3    ,   4  ,   5   ,        6
+//      id      , min_balance , max_balance ,  action , step , after , authed_by_company
+//  "risk"      ,  "1000000"  ,     "0"     ,  "add"  , "8"  ,  "2"  , "risk-committee"
+//  "small"     ,     "0"     ,   "10000"   ,  "skip" , "4"  ,  "0"  , "core-enterprise"
+// ============================================================================================================================
+func set_routing_rule(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var err error
+	fmt.Println("starting set_routing_rule")
+
+	if len(args) != 7 {
+		return shim.Error("Incorrect number of arguments. Expecting 7")
+	}
+
+	//input sanitation
+	err = sanitize_arguments(args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	var rule RoutingRule
+	rule.Id = args[0]
+	rule.MinBalance, err = strconv.Atoi(args[1])
+	if err != nil || rule.MinBalance < 0 {
+		return shim.Error("2nd argument must be a non-negative numeric string")
+	}
+	rule.MaxBalance, err = strconv.Atoi(args[2])
+	if err != nil || rule.MaxBalance < 0 || (rule.MaxBalance > 0 && rule.MaxBalance <= rule.MinBalance) {
+		return shim.Error("3rd argument must be 0 or a numeric string larger than min_balance")
+	}
+	rule.Action = args[3]
+	if rule.Action != "add" && rule.Action != "skip" {
+		return shim.Error("4th argument must be 'add' or 'skip'")
+	}
+	rule.Step, err = strconv.Atoi(args[4])
+	if err != nil || !is_review_step(rule.Step) {
+		return shim.Error("5th argument must be a reviewing step")
+	}
+	rule.After, err = strconv.Atoi(args[5])
+	if err != nil || rule.After < New || rule.After >= StepNum || rule.After == EndOf || rule.After == rule.Step {
+		return shim.Error("6th argument must be a step the added step can follow")
+	}
+	authed_by_company := args[6]
+
+	//only the company owning the step may add or skip it
+	if authed_by_company != Step_company[rule.Step] {
+		return shim.Error("The company '" + authed_by_company + "' cannot route step " + args[4])
+	}
+
+	rules, err := get_routing_rules(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	replaced := false
+	for i := range rules {
+		if rules[i].Id == rule.Id {
+			rules[i] = rule
+			replaced = true
+		}
+	}
+	if !replaced {
+		rules = append(rules, rule)
+	}
+
+	jsonAsBytes, _ := json.Marshal(rules)
+	err = stub.PutState("routing_rules", jsonAsBytes)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("- end set_routing_rule")
+	return shim.Success(jsonAsBytes)
+}
+
+// ============================================================================================================================
+// Delete Routing Rule - remove a routing rule, marbles already past the stage keep their route
+//
+// Inputs - Array of Strings
+//     0   ,        1
+//    id   , authed_by_company
+//  "risk" , "risk-committee"
+// ============================================================================================================================
+func delete_routing_rule(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var err error
+	fmt.Println("starting delete_routing_rule")
+
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 2")
+	}
+
+	//input sanitation
+	err = sanitize_arguments(args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	rules, err := get_routing_rules(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	var newRules []RoutingRule
+	found := false
+	for _, rule := range rules {
+		if rule.Id != args[0] {
+			newRules = append(newRules, rule)
+			continue
+		}
+		if args[1] != Step_company[rule.Step] {
+			return shim.Error("The company '" + args[1] + "' cannot delete routing rule " + args[0])
+		}
+		found = true
+	}
+	if !found {
+		return shim.Error("Routing rule does not exist - " + args[0])
 	}
 
-	jsonAsBytes, _ := json.Marshal(marble)         //convert to array of bytes
-	err = stub.PutState(marbleId, jsonAsBytes)     //rewrite the owner
+	jsonAsBytes, _ := json.Marshal(newRules)
+	err = stub.PutState("routing_rules", jsonAsBytes)
 	if err != nil {
 		return shim.Error(err.Error())
 	}
 
+	fmt.Println("- end delete_routing_rule")
 	return shim.Success(nil)
 }
+
+// ============================================================================================================================
+// Set Stage SLA - set how long a stage may wait and what happens afterwards
+//
+// The deadline of a stage is computed when a marble enters it, changing the SLA does not move existing deadlines.
+//
+// Inputs - Array of Strings
+//     0  ,     1     ,              2             ,         3
+//   step , sla_hours ,         on_expire          , authed_by_company
+//   "1"  ,    "72"   , "escalate" (or "fail")     , "core-enterprise"
+// ============================================================================================================================
+func set_stage_sla(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var err error
+	fmt.Println("starting set_stage_sla")
+
+	if len(args) != 4 {
+		return shim.Error("Incorrect number of arguments. Expecting 4")
+	}
+
+	//input sanitation
+	err = sanitize_arguments(args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	step, err := strconv.Atoi(args[0])
+	if err != nil || !is_review_step(step) {
+		return shim.Error("1st argument must be a reviewing step")
+	}
+	hours, err := strconv.Atoi(args[1])
+	if err != nil || hours < 0 {
+		return shim.Error("2nd argument must be a non-negative numeric string")
+	}
+	onExpire := args[2]
+	if onExpire != "fail" && onExpire != "escalate" {
+		return shim.Error("3rd argument must be 'fail' or 'escalate'")
+	}
+	authed_by_company := args[3]
+
+	//only the company owning the step may set its service level
+	if authed_by_company != Step_company[step] {
+		return shim.Error("The company '" + authed_by_company + "' cannot set the SLA of step " + args[0])
+	}
+
+	workflow, err := get_workflow(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	workflow.Stages[step].SlaHours = hours
+	workflow.Stages[step].OnExpire = onExpire
+
+	jsonAsBytes, _ := json.Marshal(workflow)
+	err = stub.PutState("workflow", jsonAsBytes)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("- end set_stage_sla")
+	return shim.Success(jsonAsBytes)
+}
+
+// ============================================================================================================================
+// Expire Stale - fail or escalate every waiting stage whose deadline is before the tx timestamp
+//
+// Meant to be called periodically by a scheduler. Each stage is escalated once; a "fail" stage ends the marble.
+// Escalating also reassigns the stage to the first supervisor when the company has an escalation chain.
+// Emits a "marbles_expired" event listing what was done.
+//
+// Inputs - none
+//
+// Returns:
+// [{"id": "m999999999", "step": 1, "deadline": "2018-09-01 10:00:00", "action": "escalate"}]
+// ============================================================================================================================
+func expire_stale(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	type Expired struct {
+		Id       string `json:"id"`
+		Step     int    `json:"step"`
+		Deadline string `json:"deadline"`
+		Action   string `json:"action"`
+		To       string `json:"to,omitempty"` //supervisor the step was reassigned to
+	}
+	var expired []Expired
+	fmt.Println("starting expire_stale")
+
+	if len(args) != 0 {
+		return shim.Error("Incorrect number of arguments. Expecting 0")
+	}
+
+	date, err := get_tx_date(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	workflow, err := get_workflow(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	marbles, err := getAllMarbles(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	for _, marble := range marbles {
+		if marble.Check[EndOf].Review != Disable || check_marble_active(marble) != nil {
+			continue
+		}
+		changed := false
+		for step := 1; step < StepNum; step++ {
+			check := &marble.Check[step]
+			if check.Review != Wait || check.Deadline == "" || check.Deadline >= date {
+				continue
+			}
+			action := workflow.Stages[step].OnExpire
+			if action == "fail" {
+				check.Review = Failure
+				check.Date = date
+				check.Comment = "expired, deadline " + check.Deadline
+				end_marble(&marble, Failure, check.UserID, check.Company, "the transaction is end failure, "+Step_name[step]+" expired !", date)
+			} else if !check.Escalated {
+				action = "escalate"
+				check.Escalated = true
+			} else {
+				continue
+			}
+			changed = true
+			item := Expired{marble.Id, step, check.Deadline, action, ""}
+			if action == "escalate" && len(check.Reassignments) == 0 {
+				company := check.Company
+				if company == "" {
+					company = Step_company[step]
+				}
+				chain, err := get_escalation_chain(stub, company)
+				if err != nil {
+					return shim.Error(err.Error())
+				}
+				if len(chain.Supervisors) > 0 {
+					re, err := reassign_stage(&marble, step, chain, date, "deadline "+check.Deadline+" passed")
+					if err == nil {
+						item.To = re.To
+					}
+				}
+			}
+			expired = append(expired, item)
+		}
+		if !changed {
+			continue
+		}
+		_, err = put_marble(stub, marble)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	expiredAsBytes, _ := json.Marshal(expired)
+	if len(expired) > 0 {
+		err = stub.SetEvent("marbles_expired", expiredAsBytes)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	fmt.Println("- end expire_stale")
+	return shim.Success(expiredAsBytes)
+}
+
+// ============================================================================================================================
+// Set Escalation Chain - set the supervisors a company's pending steps escalate to
+//
+// Inputs - Array of Strings
+//       0    ,      1      ,               2              ,        3
+//    company , after_hours ,  supervisor ids (comma sep)   , authed_by_company
+//    "bank"  ,     "48"    ,  "o444,o555"                  ,      "bank"
+// ============================================================================================================================
+func set_escalation_chain(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var err error
+	fmt.Println("starting set_escalation_chain")
+
+	if len(args) != 4 {
+		return shim.Error("Incorrect number of arguments. Expecting 4")
+	}
+
+	//input sanitation, the supervisor list may be longer than 32 characters
+	err = sanitize_arguments([]string{args[0], args[1], args[3]})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	var chain EscalationChain
+	chain.ObjectType = "escalation_chain"
+	chain.Company = args[0]
+	chain.AfterHours, err = strconv.Atoi(args[1])
+	if err != nil || chain.AfterHours <= 0 {
+		return shim.Error("2nd argument must be a positive numeric string")
+	}
+	authed_by_company := args[3]
+
+	//check authorizing company
+	if chain.Company != authed_by_company {
+		return shim.Error("The company '" + authed_by_company + "' cannot change the escalation chain of '" + chain.Company + "'")
+	}
+
+	for _, id := range strings.Split(args[2], ",") {
+		id = strings.TrimSpace(id)
+		if len(id) == 0 {
+			continue
+		}
+		user, err := get_user(stub, id)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if !user.Enabled || user.Company != chain.Company {
+			return shim.Error("user :" + id + " cannot be a supervisor of '" + chain.Company + "'")
+		}
+		chain.Supervisors = append(chain.Supervisors, id)
+	}
+	if len(chain.Supervisors) == 0 {
+		return shim.Error("3rd argument must list at least one supervisor")
+	}
+
+	jsonAsBytes, _ := json.Marshal(chain)
+	err = stub.PutState("escalation_"+chain.Company, jsonAsBytes)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("- end set_escalation_chain")
+	return shim.Success(jsonAsBytes)
+}
+
+// ============================================================================================================================
+// Escalate Marble - reassign the pending step of a marble to the next supervisor
+//
+// Allowed once the step has waited after_hours of its company's chain since it was entered or last reassigned.
+// The reassignment is recorded in the stage's Check entry and emitted as a "marble_escalated" event.
+//
+// Inputs - Array of Strings
+//        0      ,        1
+//    marble id  ,  reason (optional)
+//   "m999999999", "no answer from credit officer"
+// ============================================================================================================================
+func escalate_marble(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	type Escalation struct {
+		Id   string `json:"id"`
+		Step int    `json:"step"`
+		Reassignment
+	}
+	var err error
+	fmt.Println("starting escalate_marble")
+
+	if len(args) != 1 && len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 1 or 2")
+	}
+
+	marble, err := get_marble(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = check_marble_active(marble)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	reason := "no action within the escalation time"
+	if len(args) == 2 && len(args[1]) > 0 {
+		reason = args[1]
+	}
+
+	step := pending_step(marble)
+	if step < 0 || marble.Check[EndOf].Review != Disable {
+		return shim.Error("marble " + marble.Id + " has no pending step")
+	}
+	check := marble.Check[step]
+
+	company := check.Company
+	if company == "" {
+		company = Step_company[step]
+	}
+	chain, err := get_escalation_chain(stub, company)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if len(chain.Supervisors) == 0 {
+		return shim.Error("'" + company + "' has no escalation chain")
+	}
+
+	//the timer restarts with every reassignment
+	now, err := get_tx_time(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	since := check.EnteredAt
+	if len(check.Reassignments) > 0 {
+		since = check.Reassignments[len(check.Reassignments)-1].Date
+	}
+	waiting, err := time.Parse(DateLayout, since)
+	if err != nil {
+		return shim.Error("step " + Step_name[step] + " has no valid start date")
+	}
+	if now.Sub(waiting) < time.Duration(chain.AfterHours)*time.Hour {
+		return shim.Error("step " + Step_name[step] + " can not be escalated before " + waiting.Add(time.Duration(chain.AfterHours)*time.Hour).Format(DateLayout))
+	}
+
+	re, err := reassign_stage(&marble, step, chain, now.Format(DateLayout), reason)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	_, err = put_marble(stub, marble)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	eventAsBytes, _ := json.Marshal(Escalation{marble.Id, step, re})
+	err = stub.SetEvent("marble_escalated", eventAsBytes)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("- end escalate_marble")
+	return shim.Success(eventAsBytes)
+}
+
+// ============================================================================================================================
+// Attach Document - register an invoice, delivery note or contract on a marble by its sha256
+//
+// Any enabled participant of the marble may attach documents, the same content can only be registered once.
+//
+// Inputs - Array of Strings
+//        0      ,    1    ,     2    ,              3                ,       4       ,    5
+//    marble id  , user id , doc type ,         sha256 (hex)          ,   file name   , size (bytes)
+//   "m999999999", "o111"  , "invoice", "9f86d081884c7d659a2feaa..."  , "inv-0042.pdf" , "48213"
+// ============================================================================================================================
+func attach_document(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var err error
+	fmt.Println("starting attach_document")
+
+	if len(args) != 6 {
+		return shim.Error("Incorrect number of arguments. Expecting 6")
+	}
+
+	//input sanitation, the hash is longer than 32 characters
+	err = sanitize_arguments([]string{args[0], args[1], args[2], args[4], args[5]})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	var doc Document
+	doc.DocType = args[2]
+	if doc.DocType != "invoice" && doc.DocType != "delivery_note" && doc.DocType != "contract" && doc.DocType != "other" {
+		return shim.Error("3rd argument must be invoice, delivery_note, contract or other")
+	}
+	if !is_sha256_hex(args[3]) {
+		return shim.Error("4th argument must be a hex encoded sha256 hash")
+	}
+	doc.Hash = strings.ToLower(args[3])
+	doc.FileName = args[4]
+	doc.Size, err = strconv.ParseInt(args[5], 10, 64)
+	if err != nil || doc.Size < 0 {
+		return shim.Error("6th argument must be a non-negative numeric string")
+	}
+
+	user, err := get_user(stub, args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	marble, err := get_marble(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if !user.Enabled || !is_participant(marble, user.Id) {
+		return shim.Error("user :" + user.Id + " is not a party of marble " + marble.Id)
+	}
+	for _, registered := range marble.Documents {
+		if registered.Hash == doc.Hash {
+			return shim.Error("document " + doc.Hash + " is already registered as " + registered.FileName)
+		}
+	}
+
+	doc.Uploader = user.Id
+	doc.Stage = pending_step(marble)
+	if doc.Stage < 0 {
+		doc.Stage = EndOf
+	}
+	doc.Date, err = get_tx_date(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	marble.Documents = append(marble.Documents, doc)
+
+	jsonAsBytes, err := put_marble(stub, marble)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("- end attach_document")
+	return shim.Success(jsonAsBytes)
+}
+
+// ============================================================================================================================
+// Register Org MSP - map a company to the MSP id of its organization
+//
+// Marble updates then need an endorsement from that organization's peers (see set_marble_ep), and the MSP tells who
+// an invoker is (see report_company). Only the organization that instantiated the chaincode can register companies.
+// A company is registered once, and an MSP belongs to one company only.
+//
+// Inputs - Array of Strings
+//       0    ,     1
+//    company ,   msp id
+//    "bank"  , "BankMSP"
+// ============================================================================================================================
+func register_org_msp(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var err error
+	fmt.Println("starting register_org_msp")
+
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 2")
+	}
+
+	//input sanitation
+	err = sanitize_arguments(args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	company := args[0]
+	msp := args[1]
+
+	err = check_admin_invoker(stub, "register MSPs")
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	msps, err := get_org_msps(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if current, ok := msps[company]; ok {
+		return shim.Error("The company '" + company + "' is already registered to " + current)
+	}
+	for other, otherMsp := range msps {
+		if otherMsp == msp {
+			return shim.Error("The MSP " + msp + " is already registered to '" + other + "'")
+		}
+	}
+	msps[company] = msp
+
+	jsonAsBytes, _ := json.Marshal(msps)
+	err = stub.PutState("org_msps", jsonAsBytes)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("- end register_org_msp")
+	return shim.Success(jsonAsBytes)
+}
+
+// ============================================================================================================================
+// Init Marbles Batch - create many marbles in one transaction, all of them or none
+//
+// Every application is checked like init_marble does, plus no two applications may share an id or a contract number.
+// When one fails nothing is written and the error message is the report as JSON, so the caller sees every problem at
+// once. A 32 byte "marble_key" in the transient map encrypts all of them, private terms are only taken by init_marble.
+// "due_date" is optional, as the 7th argument of init_marble.
+//
+// Inputs - Array of strings
+//                                        0                                              ,        1
+//                                  applications                                         , authed_by_company
+// '[{"id":"m1","contact":"c1","balance":35,"title":"invoice 1","user":"o9999999999999"}]',    "supplier"
+//
+// Returns - {"created": 1, "results": [{"index": 0, "id": "m1", "ok": true}]}
+// ============================================================================================================================
+func init_marbles_batch(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	type Application struct {
+		Id      string `json:"id"`
+		Contact string `json:"contact"`
+		Balance int    `json:"balance"`
+		Title   string `json:"title"`
+		User    string `json:"user"`
+		DueDate string `json:"due_date,omitempty"`
+	}
+	type ItemResult struct {
+		Index int    `json:"index"`
+		Id    string `json:"id"`
+		Ok    bool   `json:"ok"`
+		Error string `json:"error,omitempty"`
+	}
+	type BatchReport struct {
+		Created int          `json:"created"`
+		Results []ItemResult `json:"results"`
+	}
+	var applications []Application
+	var report BatchReport
+	fmt.Println("starting init_marbles_batch")
+
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 2")
+	}
+	err := json.Unmarshal([]byte(args[0]), &applications)
+	if err != nil {
+		return shim.Error("1st argument must be a JSON array of applications")
+	}
+	if len(applications) == 0 || len(applications) > BatchMax {
+		return shim.Error("a batch holds 1 to " + strconv.Itoa(BatchMax) + " applications")
+	}
+	authed_by_company := args[1]
+
+	_, isPrivate, err := get_private_input(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if isPrivate {
+		return shim.Error("private terms are not taken in a batch, use init_marble")
+	}
+	key, _, err := get_marble_key(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	date, err := get_tx_date(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	var marbles []Marble
+	ids := map[string]int{}
+	contacts := map[string]int{}
+	failed := false
+	for i, app := range applications {
+		result := ItemResult{Index: i, Id: app.Id}
+		err = sanitize_arguments([]string{app.Id, app.Contact, app.Title, app.User})
+		if err == nil && app.Balance < 0 {
+			err = errors.New("balance must not be negative")
+		}
+		if err == nil {
+			if first, ok := ids[app.Id]; ok {
+				err = errors.New("id " + app.Id + " is also used by application " + strconv.Itoa(first))
+			} else if first, ok := contacts[app.Contact]; ok {
+				err = errors.New("contract " + app.Contact + " is also used by application " + strconv.Itoa(first))
+			}
+		}
+		if err == nil {
+			ids[app.Id] = i
+			contacts[app.Contact] = i
+			var marble Marble
+			marble, err = build_marble(stub, app.Id, app.Contact, app.Balance, app.Title, app.User, authed_by_company, date, nil, key)
+			if err == nil && app.DueDate != "" {
+				marble.DueDate, err = parse_due_date(app.DueDate)
+			}
+			marbles = append(marbles, marble)
+		}
+		if err != nil {
+			result.Error = err.Error()
+			failed = true
+		} else {
+			result.Ok = true
+		}
+		report.Results = append(report.Results, result)
+	}
+
+	if failed {
+		reportAsBytes, _ := json.Marshal(report)
+		return shim.Error(string(reportAsBytes))         //nothing is written
+	}
+	for _, marble := range marbles {
+		_, err = put_marble(stub, marble)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+	report.Created = len(marbles)
+
+	fmt.Println("- end init_marbles_batch")
+	reportAsBytes, _ := json.Marshal(report)
+	return shim.Success(reportAsBytes)
+}
+
+// ============================================================================================================================
+// Review Marbles Batch - the same review for many marbles, e.g. a core enterprise confirming a supplier's invoices
+//
+// Each marble is checked like review_marble does. A marble that fails is reported and left as it was, the others are
+// written, unless all_or_nothing is "true": then nothing is written and the error message is the report as JSON.
+//
+// Inputs - Array of strings
+//         0           ,        1         ,   2    ,     3     ,       4
+//     marble ids      , user id / company, state  ,  comment  , all_or_nothing
+//  '["m1","m2","m3"]' , "o2222222222"    ,  "2"   , "confirmed", "false"
+//
+// Returns - {"reviewed": 2, "results": [{"id": "m1", "ok": true}, {"id": "m2", "ok": false, "error": "..."}]}
+// ============================================================================================================================
+func review_marbles_batch(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	type ItemResult struct {
+		Id    string `json:"id"`
+		Ok    bool   `json:"ok"`
+		Error string `json:"error,omitempty"`
+	}
+	type BatchReport struct {
+		Reviewed int          `json:"reviewed"`
+		Results  []ItemResult `json:"results"`
+	}
+	var ids []string
+	var report BatchReport
+	fmt.Println("starting review_marbles_batch")
+
+	if len(args) != 5 {
+		return shim.Error("Incorrect number of arguments. Expecting 5")
+	}
+	err := json.Unmarshal([]byte(args[0]), &ids)
+	if err != nil {
+		return shim.Error("1st argument must be a JSON array of marble ids")
+	}
+	if len(ids) == 0 || len(ids) > BatchMax {
+		return shim.Error("a batch holds 1 to " + strconv.Itoa(BatchMax) + " marbles")
+	}
+	//args[1] 可以是userid，也可以是公司名, 同review_marble
+	userID := args[1]
+	if _, err := get_user(stub, userID); err != nil {
+		userC, _ := getUserByCompany(stub, userID)
+		userID = userC.Id
+	}
+	user, err := get_user(stub, userID)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if !user.Enabled {
+		return shim.Error("user is disable -" + userID)
+	}
+	state, err := strconv.Atoi(args[2])
+	if err != nil || (state != Success && state != Failure) {
+		return shim.Error("3rd argument must be 2 (success) or 3 (failure)")
+	}
+	commont := args[3]
+	allOrNothing, err := strconv.ParseBool(args[4])
+	if err != nil {
+		return shim.Error("5th argument must be true or false")
+	}
+	date, err := get_tx_date(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	var marbles []Marble
+	seen := map[string]bool{}
+	failed := false
+	for _, id := range ids {
+		result := ItemResult{Id: id}
+		var marble Marble
+		if seen[id] {
+			err = errors.New("marble " + id + " is listed twice")
+		} else {
+			seen[id] = true
+			//review_one may have kept a bank comment privately, put it back if the review fails
+			privateAsBytes, privateErr := stub.GetPrivateData(PrivateCollection, id)
+			if privateErr != nil {
+				return shim.Error("Failed to get private terms of " + id + " - " + privateErr.Error())
+			}
+			marble, err = review_one(stub, id, user, state, commont, date)
+			if err != nil && len(privateAsBytes) > 0 {
+				privateErr = stub.PutPrivateData(PrivateCollection, id, privateAsBytes)
+				if privateErr != nil {
+					return shim.Error("Failed to restore private terms of " + id + " - " + privateErr.Error())
+				}
+			}
+		}
+		if err != nil {
+			result.Error = err.Error()
+			failed = true
+		} else {
+			result.Ok = true
+			marbles = append(marbles, marble)
+		}
+		report.Results = append(report.Results, result)
+	}
+
+	if failed && allOrNothing {
+		reportAsBytes, _ := json.Marshal(report)
+		return shim.Error(string(reportAsBytes))         //nothing is written
+	}
+	for _, marble := range marbles {
+		_, err = put_marble(stub, marble)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+	report.Reviewed = len(marbles)
+
+	fmt.Println("- end review_marbles_batch")
+	reportAsBytes, _ := json.Marshal(report)
+	return shim.Success(reportAsBytes)
+}
+
+// what is left of balance once the children are split off it, each child is checked against what the ones before
+// it left so the sum cannot overflow
+func split_balance(balance int, children []int) (int, error) {
+	left := balance
+	for i, amount := range children {
+		if amount <= 0 {
+			return balance, errors.New("child " + strconv.Itoa(i) + " must have a positive balance")
+		}
+		if amount > left {
+			return balance, errors.New("the children add up to more than the balance " + strconv.Itoa(balance))
+		}
+		left -= amount
+	}
+	return left, nil
+}
+
+// ============================================================================================================================
+// Split Marble - pass part of an approved receivable on to tier-2 suppliers
+//
+// The holder of a marble the core enterprise has approved, and that is not financed yet, divides part of its balance
+// into child marbles owned by other suppliers. The children keep the core enterprise's approval and wait for the next
+// stage of their own route (normally the bank), so each one is financed on its own. The parent keeps the rest; when
+// nothing is left it ends as "split". Private and encrypted marbles cannot be split, their balance is not on the ledger.
+//
+// Inputs - Array of strings
+//        0       ,      1     ,                             2
+//    parent id   ,  holder id ,                          children
+//  "m999999999"  ,  "o1111"   , '[{"id":"m999999999a","user":"o3333","balance":20}]'
+// ============================================================================================================================
+func split_marble(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	type Child struct {
+		Id      string `json:"id"`
+		User    string `json:"user"`
+		Balance int    `json:"balance"`
+	}
+	var children []Child
+	fmt.Println("starting split_marble")
+
+	if len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting 3")
+	}
+	err := json.Unmarshal([]byte(args[2]), &children)
+	if err != nil || len(children) == 0 {
+		return shim.Error("3rd argument must be a JSON array of children")
+	}
+	if len(children) > BatchMax {
+		return shim.Error("a marble splits into at most " + strconv.Itoa(BatchMax) + " children")
+	}
+
+	parent, err := get_marble(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	holder, err := get_user(stub, args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if parent.User.Id != holder.Id || !holder.Enabled {
+		return shim.Error("user :" + holder.Id + " does not hold marble " + parent.Id)
+	}
+	err = check_marble_active(parent)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if parent.Encrypted || parent.PrivateHash != "" {
+		return shim.Error("marble " + parent.Id + " keeps its balance off the ledger and cannot be split")
+	}
+	if pending_title(&parent) != nil {
+		return shim.Error("marble " + parent.Id + " has a pending transfer")
+	}
+	if parent.Syndication != nil {
+		return shim.Error("marble " + parent.Id + " is being syndicated and cannot be split")
+	}
+	step := pending_step(parent)
+	if parent.Check[New].Review != Success || parent.Check[CompanyCheck].Review != Success || step < 0 || parent.Check[BankCheck].Review == Success {
+		return shim.Error("only a marble approved by the core enterprise and not financed yet can be split")
+	}
+
+	date, err := get_tx_date(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	var balances []int
+	for _, c := range children {
+		balances = append(balances, c.Balance)
+	}
+	left, err := split_balance(parent.Balance, balances)
+	if err != nil {
+		return shim.Error("marble " + parent.Id + ": " + err.Error())
+	}
+
+	seen := map[string]bool{}
+	var childMarbles []Marble
+	for i, c := range children {
+		err = sanitize_arguments([]string{c.Id, c.User})
+		if err != nil {
+			return shim.Error("child " + strconv.Itoa(i) + ": " + err.Error())
+		}
+		if seen[c.Id] {
+			return shim.Error("child id " + c.Id + " is listed twice")
+		}
+		seen[c.Id] = true
+		if _, err := get_marble(stub, c.Id); err == nil {
+			return shim.Error("This marble already exists - " + c.Id)
+		}
+		owner, err := get_user(stub, c.User)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if !owner.Enabled || owner.Company != Step_company[New] || owner.Id == holder.Id {
+			return shim.Error("user :" + owner.Id + " cannot hold a child of marble " + parent.Id + ", it must be another supplier")
+		}
+
+		var child Marble
+		child.ObjectType = "marble"
+		child.Id = c.Id
+		child.Contact = parent.Contact
+		child.Balance = c.Balance
+		child.Title = parent.Title
+		child.Product = parent.Product
+		child.User.Id = owner.Id
+		child.User.Username = owner.Username
+		child.User.Company = owner.Company
+		child.Parent = parent.Id
+		child.Check[New].UserID = holder.Id
+		child.Check[New].Company = holder.Company
+		child.Check[New].Review = Success
+		child.Check[New].Date = date
+		child.Check[New].Comment = "split from " + parent.Id
+		approval := parent.Check[CompanyCheck]                 //the core enterprise's approval carries over
+		approval.Seq, approval.PrevHash, approval.Hash = 0, "", ""
+		child.Check[CompanyCheck] = approval
+
+		next, err := route_marble(stub, &child, intake_done(child))
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		nextUser, err := getStageUser(stub, child, next)
+		if err != nil {
+			return shim.Error("can not get the next step user !!")
+		}
+		err = enter_stage(stub, &child, next, nextUser.Id, Step_company[next], date)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		childMarbles = append(childMarbles, child)
+		parent.Children = append(parent.Children, child.Id)
+	}
+	parent.Balance = left
+	if parent.Balance == 0 {
+		parent.Check[step].Review = Disable                    //nothing left to finance
+		parent.Status = Split
+		end_marble(&parent, Success, holder.Id, holder.Company, "the marble is fully split into its children", date)
+	}
+	parentAsBytes, err := put_marble(stub, parent)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	for _, child := range childMarbles {
+		_, err = put_marble(stub, child)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	fmt.Println("- end split_marble")
+	return shim.Success(parentAsBytes)
+}
+
+// ============================================================================================================================
+// Assign Marble - ask to transfer the right to collect a receivable to another supplier
+//
+// The transfer waits for the core enterprise, who owes the money, to acknowledge it (acknowledge_assignment). Only a
+// running marble that is not financed yet can change hands, once the bank has paid the receivable is pledged to it.
+//
+// Inputs - Array of strings
+//        0      ,      1     ,        2
+//    marble id  ,  holder id , new holder id
+//  "m999999999" ,  "o1111"   ,   "o3333"
+// ============================================================================================================================
+func assign_marble(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	fmt.Println("starting assign_marble")
+
+	if len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting 3")
+	}
+	err := sanitize_arguments(args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	marble, err := get_marble(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	holder, err := get_user(stub, args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if marble.User.Id != holder.Id || !holder.Enabled {
+		return shim.Error("user :" + holder.Id + " does not hold marble " + marble.Id)
+	}
+	newHolder, err := get_user(stub, args[2])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if !newHolder.Enabled || newHolder.Company != Step_company[New] || newHolder.Id == holder.Id {
+		return shim.Error("user :" + newHolder.Id + " cannot take over marble " + marble.Id + ", it must be another supplier")
+	}
+	err = check_marble_active(marble)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if marble.Check[EndOf].Review != Disable || marble.Check[BankCheck].Review == Success {
+		return shim.Error("marble " + marble.Id + " is financed or ended and cannot change hands")
+	}
+	if pending_title(&marble) != nil {
+		return shim.Error("marble " + marble.Id + " already has a pending transfer")
+	}
+
+	date, err := get_tx_date(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	marble.Titles = append(marble.Titles, TitleTransfer{From: holder.Id, To: newHolder.Id, RequestedAt: date, Status: "pending"})
+
+	jsonAsBytes, err := put_marble(stub, marble)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	fmt.Println("- end assign_marble")
+	return shim.Success(jsonAsBytes)
+}
+
+// the marble changes hands, a supplier stage already waiting (e.g. New of a payable) now waits for the new holder
+func transfer_holder(marble *Marble, newHolder User) {
+	marble.User.Id = newHolder.Id
+	marble.User.Username = newHolder.Username
+	marble.User.Company = newHolder.Company
+	if step := pending_step(*marble); step >= 0 && Step_company[step] == Step_company[New] {
+		marble.Check[step].UserID = newHolder.Id
+		marble.Check[step].Company = newHolder.Company
+	}
+}
+
+// ============================================================================================================================
+// Acknowledge Assignment - the core enterprise accepts or rejects the pending transfer of a marble
+//
+// When accepted, a supplier stage the marble is waiting for moves to the new holder along with the marble.
+//
+// Inputs - Array of strings
+//        0      ,          1            ,          2           ,     3
+//    marble id  , user id / company     , state 2 (accept) or 3, comment
+//  "m999999999" , "core-enterprise"     ,         "2"          , "noted, we pay o3333"
+// ============================================================================================================================
+func acknowledge_assignment(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	fmt.Println("starting acknowledge_assignment")
+
+	if len(args) != 4 {
+		return shim.Error("Incorrect number of arguments. Expecting 4")
+	}
+	userID := args[1]
+	if _, err := get_user(stub, userID); err != nil {
+		userC, _ := getUserByCompany(stub, userID)
+		userID = userC.Id
+	}
+	user, err := get_user(stub, userID)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if !user.Enabled || user.Company != Step_company[CompanyCheck] {
+		return shim.Error("only the core enterprise can acknowledge a transfer")
+	}
+	state, err := strconv.Atoi(args[2])
+	if err != nil || (state != Success && state != Failure) {
+		return shim.Error("3rd argument must be 2 (accept) or 3 (reject)")
+	}
+
+	marble, err := get_marble(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = check_marble_active(marble)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	title := pending_title(&marble)
+	if title == nil {
+		return shim.Error("marble " + marble.Id + " has no pending transfer")
+	}
+
+	date, err := get_tx_date(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	title.AckBy = user.Id
+	title.AckAt = date
+	title.Comment = args[3]
+	if state == Failure {
+		title.Status = "rejected"
+	} else {
+		newHolder, err := get_user(stub, title.To)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if !newHolder.Enabled {
+			return shim.Error("user :" + newHolder.Id + " is disabled, reject the transfer")
+		}
+		if marble.Check[BankCheck].Review == Success {
+			return shim.Error("marble " + marble.Id + " was financed meanwhile, reject the transfer")
+		}
+		title.Status = "acknowledged"
+		transfer_holder(&marble, newHolder)
+	}
+
+	jsonAsBytes, err := put_marble(stub, marble)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	fmt.Println("- end acknowledge_assignment")
+	return shim.Success(jsonAsBytes)
+}
+
+// ============================================================================================================================
+// Rebuild Indexes - write the "user~marble" and stats index entries of the marbles, after upgrading. Admin only
+//
+// Marbles written before the indexes existed are not counted by get_portfolio_stats until this ran over them, and
+// read_allmarble scans every marble until it went through all of them. Large ledgers can be done in batches: pass
+// the "next" id of the previous call as start id.
+//
+// Inputs - Array of strings
+//     0 (optional) , 1 (optional)
+//      start id    ,   count
+//     "m0"         ,   "500"
+// ============================================================================================================================
+func rebuild_indexes(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	type RebuildResult struct {
+		Indexed int    `json:"indexed"`
+		Next    string `json:"next"`              //empty when every marble is indexed
+	}
+
+	if len(args) != 0 && len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 0 or 2")
+	}
+	err := check_admin_invoker(stub, "rebuild the indexes")
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	start, count := "m0", 0
+	if len(args) == 2 {
+		start = args[0]
+		count, err = strconv.Atoi(args[1])
+		if err != nil || count <= 0 {
+			return shim.Error("2nd argument must be a positive count of marbles")
+		}
+	}
+
+	resultsIterator, err := stub.GetStateByRange(start, "m9999999999999999999")
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer resultsIterator.Close()
+	var result RebuildResult
+	for resultsIterator.HasNext() {
+		aKeyValue, err := resultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if count > 0 && result.Indexed == count {
+			result.Next = aKeyValue.Key
+			break
+		}
+		var marble Marble
+		json.Unmarshal(aKeyValue.Value, &marble)
+		err = index_marble(stub, aKeyValue.Key, &marble)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		result.Indexed++
+	}
+	if result.Next == "" {
+		err = stub.PutState("indexes_built", []byte("true"))
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	resultAsBytes, _ := json.Marshal(result)
+	return shim.Success(resultAsBytes)
+}
+
+// ============================================================================================================================
+// Upload Payable - the core enterprise offers an approved payable to its supplier for early payment (reverse factoring)
+//
+// The marble starts approved by the core enterprise and waits for the supplier to opt in at New, with review_marble
+// (2 takes the early payment, 3 declines it). Then it follows Reverse_route like any marble. The balance can be kept
+// private or encrypted through the transient map as with init_marble.
+//
+// Inputs - Array of strings
+//        0      ,      1       ,    2    ,     3     ,     4       ,          5                        ,  6 (optional)
+//       id      ,   contact    , balance ,   title   , supplier id , core enterprise user id / company ,  due date
+//  "m999999999" , "PO-2018-001",  "350"  , "invoice" ,  "o1111"    ,   "core-enterprise"               , "2018-09-30"
+// ============================================================================================================================
+func upload_payable(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	fmt.Println("starting upload_payable")
+
+	if len(args) != 6 && len(args) != 7 {
+		return shim.Error("Incorrect number of arguments. Expecting 6 or 7")
+	}
+	err := sanitize_arguments(args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	dueDate := ""
+	if len(args) == 7 {
+		dueDate, err = parse_due_date(args[6])
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+	id := args[0]
+	balance, err := strconv.Atoi(args[2])
+	if err != nil || balance < 0 {
+		return shim.Error("3rd argument must be a numeric string")
+	}
+
+	coreID := args[5]
+	if _, err := get_user(stub, coreID); err != nil {
+		userC, _ := getUserByCompany(stub, coreID)
+		coreID = userC.Id
+	}
+	core, err := get_user(stub, coreID)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if !core.Enabled || core.Company != Step_company[CompanyCheck] {
+		return shim.Error("only the core enterprise can upload payables")
+	}
+	supplier, err := get_user(stub, args[4])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if !supplier.Enabled || supplier.Company != Step_company[New] {
+		return shim.Error("user :" + supplier.Id + " is not a supplier")
+	}
+	if _, err := get_marble(stub, id); err == nil {
+		return shim.Error("This marble already exists - " + id)
+	}
+
+	private, isPrivate, err := get_private_input(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if isPrivate {
+		if balance != 0 {
+			return shim.Error("3rd argument must be 0 when the balance is passed in the transient map")
+		}
+		balance = private.Balance
+	}
+	key, isEncrypted, err := get_marble_key(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if isPrivate && isEncrypted {
+		return shim.Error("pass either marble_private or marble_key, not both")
+	}
+	if balance <= 0 {
+		return shim.Error("a payable must have a positive balance")
+	}
+	date, err := get_tx_date(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	var marble Marble
+	marble.ObjectType = "marble"
+	marble.Id = id
+	marble.Contact = args[1]
+	marble.Balance = balance
+	marble.Title = args[3]
+	marble.Product = Reverse
+	marble.DueDate = dueDate
+	marble.User.Id = supplier.Id
+	marble.User.Username = supplier.Username
+	marble.User.Company = supplier.Company
+	marble.Check[CompanyCheck].UserID = core.Id
+	marble.Check[CompanyCheck].Company = core.Company
+	marble.Check[CompanyCheck].Review = Success
+	marble.Check[CompanyCheck].Date = date
+	marble.Check[CompanyCheck].Comment = "payable approved by the core enterprise"
+
+	//供应商确认(New)是反向保理路径上的下一阶段
+	next, err := route_marble(stub, &marble, CompanyCheck)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if next != New {
+		return shim.Error("the routing rules must leave " + Step_name[New] + " right after " + Step_name[CompanyCheck] + " for payables")
+	}
+	err = enter_stage(stub, &marble, next, supplier.Id, supplier.Company, date)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if isPrivate {
+		err = put_marble_private(stub, &marble, private)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+	if isEncrypted {
+		err = encrypt_marble(stub, &marble, key)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	jsonAsBytes, err := put_marble(stub, marble)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	fmt.Println("- end upload_payable")
+	return shim.Success(jsonAsBytes)
+}
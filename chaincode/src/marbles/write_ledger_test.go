@@ -0,0 +1,89 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestSplitBalance(t *testing.T) {
+	tests := []struct {
+		name     string
+		balance  int
+		children []int
+		left     int
+		ok       bool
+	}{
+		{"part", 100, []int{20, 30}, 50, true},
+		{"all", 100, []int{60, 40}, 0, true},
+		{"one", 1, []int{1}, 0, true},
+		{"more than the balance", 100, []int{60, 41}, 100, false},
+		{"zero child", 100, []int{0}, 100, false},
+		{"negative child", 100, []int{150, -60}, 100, false},
+		{"overflowing sum", 100, []int{math.MaxInt64, math.MaxInt64, 2}, 100, false},
+		{"overflow to a small sum", 100, []int{50, math.MaxInt64, math.MaxInt64}, 100, false},
+	}
+	for _, test := range tests {
+		left, err := split_balance(test.balance, test.children)
+		if (err == nil) != test.ok {
+			t.Errorf("%s: got error %v, want ok %v", test.name, err, test.ok)
+		}
+		if left != test.left {
+			t.Errorf("%s: left %d, want %d", test.name, left, test.left)
+		}
+	}
+}
+
+func TestTransferHolder(t *testing.T) {
+	from := User{Id: "o1", Username: "sup", Company: "supplier"}
+	to := User{Id: "o4", Username: "tier2", Company: "supplier"}
+	tests := []struct {
+		name    string
+		pending int
+		moved   bool
+	}{
+		{"payable waiting at New", New, true},
+		{"waiting at SuppRecv", SuppRecv, true},
+		{"waiting at SuppRepayment", SuppRepayment, true},
+		{"waiting for the core enterprise", CompanyCheck, false},
+		{"waiting for the bank", BankCheck, false},
+	}
+	for _, test := range tests {
+		var marble Marble
+		marble.User = UserRelation{Id: from.Id, Username: from.Username, Company: from.Company}
+		marble.Check[test.pending] = CheckInfo{UserID: "o9", Company: Step_company[test.pending], Review: Wait}
+		if Step_company[test.pending] == from.Company {
+			marble.Check[test.pending].UserID = from.Id
+		}
+		before := marble.Check[test.pending]
+		transfer_holder(&marble, to)
+		if marble.User.Id != to.Id || marble.User.Username != to.Username {
+			t.Errorf("%s: holder is %+v", test.name, marble.User)
+		}
+		check := marble.Check[test.pending]
+		if test.moved && (check.UserID != to.Id || check.Company != to.Company || check.Review != Wait) {
+			t.Errorf("%s: pending stage is %+v, want it to wait for %s", test.name, check, to.Id)
+		}
+		if !test.moved && (check.UserID != before.UserID || check.Company != before.Company) {
+			t.Errorf("%s: pending stage changed to %+v", test.name, check)
+		}
+	}
+}
@@ -0,0 +1,433 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+
+// marblesverify checks an exported marble record offline, no peer or network needed.
+//
+//	marblesverify -workflow workflow.json history.json
+//
+// history.json is the output of the getHistory query (or of read for a single marble), workflow.json the output of
+// read_workflow. For every version of the marble it checks
+//   - the hash chain of the decisions, as the chaincode's verify_marble_chain does (see chaincode/src/marbles/chain.go)
+//   - stage ordering: decisions follow the route of the marble, nothing is decided after a failure
+//   - role consistency: every decision and signature was made by the company owning that stage
+// and across versions that a sealed decision never changes once written.
+//
+// The hashes of an encrypted marble cover the encrypted comments, so export it without passing the marble key. A
+// decrypted export is reported as such instead of as tampered with.
+//
+// Exit status is 0 when the record is valid, 1 when problems were found and 2 when the files cannot be read.
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// the steps and states the chaincode uses, see marbles.go
+const (
+	EndOf   = 7
+	Success = 2
+	Failure = 3
+)
+
+// ============================================================================================================================
+// Record types - the subset of the chaincode's JSON needed for verification
+// ============================================================================================================================
+type Signature struct {
+	UserID  string `json:"userid"`
+	Company string `json:"company"`
+	Date    string `json:"date"`
+	Review  int    `json:"review"`
+	Comment string `json:"comment"`
+}
+
+type CheckInfo struct {
+	UserID     string      `json:"userid"`
+	Company    string      `json:"company"`
+	Date       string      `json:"date"`
+	Review     int         `json:"review"`
+	Comment    string      `json:"comment"`
+	Signatures []Signature `json:"signatures,omitempty"`
+	Seq        int         `json:"seq,omitempty"`
+	PrevHash   string      `json:"prev_hash,omitempty"`
+	Hash       string      `json:"hash,omitempty"`
+}
+
+type Marble struct {
+	Id        string      `json:"id"`
+	Check     []CheckInfo `json:"check"`
+	Route     []int       `json:"route,omitempty"`
+	Product   string      `json:"product,omitempty"`
+	ChainHead string      `json:"chain_head,omitempty"`
+	Encrypted bool        `json:"encrypted,omitempty"`
+}
+
+type Version struct {
+	TxId      string `json:"txId"`
+	Timestamp string `json:"timestamp"`
+	IsDelete  bool   `json:"is_delete"`
+	Value     Marble `json:"value"`
+}
+
+type StageDef struct {
+	Step    int    `json:"step"`
+	Name    string `json:"name"`
+	Company string `json:"company"`
+}
+
+type Workflow struct {
+	Stages        []StageDef       `json:"stages"`
+	DefaultRoute  []int            `json:"default_route"`
+	ProductRoutes map[string][]int `json:"product_routes"`
+}
+
+// the hashed content of a decision, must stay identical to ChainEntry in chain.go
+type ChainEntry struct {
+	MarbleId   string      `json:"marble_id"`
+	Seq        int         `json:"seq"`
+	PrevHash   string      `json:"prev_hash"`
+	Step       int         `json:"step"`
+	UserID     string      `json:"userid"`
+	Company    string      `json:"company"`
+	Date       string      `json:"date"`
+	Review     int         `json:"review"`
+	Comment    string      `json:"comment"`
+	Signatures []Signature `json:"signatures"`
+}
+
+func main() {
+	workflowFile := flag.String("workflow", "", "workflow definition, the output of read_workflow")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: marblesverify -workflow workflow.json history.json")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if *workflowFile == "" || flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	var workflow Workflow
+	if err := read_json(*workflowFile, &workflow); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if len(workflow.Stages) == 0 {
+		fmt.Fprintln(os.Stderr, *workflowFile+": no stages")
+		os.Exit(2)
+	}
+	versions, err := read_versions(flag.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	problems := verify(workflow, versions)
+	for _, problem := range problems {
+		fmt.Println(problem)
+	}
+	if len(problems) > 0 {
+		fmt.Printf("INVALID: %d problem(s) in %d version(s)\n", len(problems), len(versions))
+		os.Exit(1)
+	}
+	fmt.Printf("OK: %d version(s) verified\n", len(versions))
+}
+
+func read_json(file string, v interface{}) error {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	if err = json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("%s: %v", file, err)
+	}
+	return nil
+}
+
+// a getHistory export is an array of versions, a single marble is an object
+func read_versions(file string) ([]Version, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var versions []Version
+	if strings.HasPrefix(strings.TrimSpace(string(data)), "[") {
+		err = json.Unmarshal(data, &versions)
+	} else {
+		var marble Marble
+		err = json.Unmarshal(data, &marble)
+		versions = append(versions, Version{TxId: "current", Value: marble})
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	if len(versions) == 0 {
+		return nil, fmt.Errorf("%s: no marble in the export", file)
+	}
+	return versions, nil
+}
+
+// ============================================================================================================================
+// Verify - all problems of an exported record, none when it is valid
+// ============================================================================================================================
+func verify(workflow Workflow, versions []Version) []string {
+	var problems []string
+	sealed := map[int]string{}                                  //seq -> hash, as first seen
+	id := ""
+	for i, version := range versions {
+		label := "version " + strconv.Itoa(i+1) + " (" + version.TxId + ")"
+		if version.IsDelete {
+			continue
+		}
+		marble := version.Value
+		if id == "" {
+			id = marble.Id
+		} else if marble.Id != id {
+			problems = append(problems, label+": marble id "+marble.Id+", expected "+id)
+		}
+		for _, problem := range check_version(workflow, marble) {
+			problems = append(problems, label+": "+problem)
+		}
+
+		for _, check := range marble.Check {
+			if check.Seq == 0 {
+				continue
+			}
+			if hash, ok := sealed[check.Seq]; ok && hash != check.Hash {
+				problems = append(problems, label+": decision "+strconv.Itoa(check.Seq)+" differs from the earlier version")
+			} else if !ok {
+				sealed[check.Seq] = check.Hash
+			}
+		}
+		for seq := range sealed {
+			if !has_seq(marble, seq) {
+				problems = append(problems, label+": decision "+strconv.Itoa(seq)+" of an earlier version is missing")
+			}
+		}
+	}
+	return problems
+}
+
+func has_seq(marble Marble, seq int) bool {
+	for _, check := range marble.Check {
+		if check.Seq == seq {
+			return true
+		}
+	}
+	return false
+}
+
+func check_version(workflow Workflow, marble Marble) []string {
+	var problems []string
+	stages := map[int]StageDef{}
+	for _, stage := range workflow.Stages {
+		stages[stage.Step] = stage
+	}
+	name := func(step int) string {
+		if stage, ok := stages[step]; ok && stage.Name != "" {
+			return stage.Name
+		}
+		return "step " + strconv.Itoa(step)
+	}
+
+	// ---- hash chain ---- //
+	var steps []int
+	for step, check := range marble.Check {
+		if check.Seq > 0 || check.Hash != "" {
+			steps = append(steps, step)
+		} else if is_decided(check) {
+			problems = append(problems, name(step)+" is decided but not sealed")
+		}
+	}
+	sort.SliceStable(steps, func(i, j int) bool {
+		return marble.Check[steps[i]].Seq < marble.Check[steps[j]].Seq
+	})
+	prev := ""
+	for i, step := range steps {
+		check := marble.Check[step]
+		if check.Seq != i+1 {
+			problems = append(problems, name(step)+" has seq "+strconv.Itoa(check.Seq)+", expected "+strconv.Itoa(i+1))
+		}
+		if check.PrevHash != prev {
+			problems = append(problems, name(step)+" does not link to the previous decision")
+		}
+		if chain_hash(marble.Id, step, check) != check.Hash {
+			if marble.Encrypted && is_decrypted(check) {
+				problems = append(problems, name(step)+" cannot be verified, its comment was decrypted: export without the marble key")
+			} else {
+				problems = append(problems, name(step)+" was changed after it was sealed")
+			}
+		}
+		prev = check.Hash
+	}
+	if marble.ChainHead != prev {
+		problems = append(problems, "chain head does not match the last decision")
+	}
+
+	// ---- stage ordering ---- //
+	route := marble.Route
+	if len(route) == 0 && marble.Product != "" {
+		route = workflow.ProductRoutes[marble.Product]
+	}
+	if len(route) == 0 {
+		route = workflow.DefaultRoute
+	}
+	if len(route) == 0 {
+		route = []int{0, 1, 2, 3, 4, 5, 6, EndOf}
+	}
+	position := map[int]int{}
+	var valid []int                                             //the route without the steps it cannot have
+	for _, step := range route {
+		_, known := stages[step]
+		switch {
+		case step < 0 || step >= len(marble.Check):
+			problems = append(problems, "the route has "+name(step)+", the marble has "+strconv.Itoa(len(marble.Check))+" stages")
+		case !known && step != EndOf:
+			problems = append(problems, "the route has "+name(step)+", which is not in the workflow definition")
+		case has_step(valid, step):
+			problems = append(problems, "the route has "+name(step)+" twice")
+		default:
+			position[step] = len(valid)
+			valid = append(valid, step)
+		}
+	}
+	route = valid
+	last := -1
+	failed := false
+	for _, step := range steps {
+		check := marble.Check[step]
+		if step == EndOf {
+			continue
+		}
+		pos, ok := position[step]
+		if !ok {
+			problems = append(problems, name(step)+" is decided but not on the route of the marble")
+			continue
+		}
+		if failed {
+			problems = append(problems, name(step)+" is decided after a failed stage")
+		}
+		if pos <= last {
+			problems = append(problems, name(step)+" is decided out of route order")
+		}
+		for _, before := range route[last+1 : max_int(pos, last+1)] {
+			if before != EndOf && !is_decided(marble.Check[before]) {
+				problems = append(problems, name(step)+" is decided while "+name(before)+" is not")
+			}
+		}
+		if pos > last {
+			last = pos
+		}
+		failed = failed || check.Review == Failure
+	}
+	if len(marble.Check) > EndOf && is_decided(marble.Check[EndOf]) {
+		end := marble.Check[EndOf]
+		if len(steps) > 0 && steps[len(steps)-1] != EndOf {
+			problems = append(problems, name(EndOf)+" is not the last decision")
+		}
+		if failed && end.Review != Failure {
+			problems = append(problems, name(EndOf)+" is a success although a stage failed")
+		}
+	}
+
+	// ---- roles ---- //
+	for _, step := range steps {
+		if step == EndOf {
+			continue                                        //closed by whichever company made the last decision
+		}
+		check := marble.Check[step]
+		stage, ok := stages[step]
+		if !ok {
+			problems = append(problems, name(step)+" is not in the workflow definition")
+			continue
+		}
+		if check.Company != stage.Company {
+			problems = append(problems, name(step)+" was decided by "+check.Company+", the stage belongs to "+stage.Company)
+		}
+		for _, sig := range check.Signatures {
+			if sig.Company != stage.Company {
+				problems = append(problems, name(step)+" was signed by "+sig.UserID+" of "+sig.Company+", the stage belongs to "+stage.Company)
+			}
+		}
+	}
+	return problems
+}
+
+func chain_hash(marbleId string, step int, check CheckInfo) string {
+	entry := ChainEntry{
+		MarbleId:   marbleId,
+		Seq:        check.Seq,
+		PrevHash:   check.PrevHash,
+		Step:       step,
+		UserID:     check.UserID,
+		Company:    check.Company,
+		Date:       check.Date,
+		Review:     check.Review,
+		Comment:    check.Comment,
+		Signatures: check.Signatures,
+	}
+	if len(entry.Signatures) == 0 {
+		entry.Signatures = nil
+	}
+	entryAsBytes, _ := json.Marshal(entry)
+	hash := sha256.Sum256(entryAsBytes)
+	return hex.EncodeToString(hash[:])
+}
+
+// an encrypted marble's comment or signature comment without the "enc:" prefix
+func is_decrypted(check CheckInfo) bool {
+	if check.Comment != "" && !strings.HasPrefix(check.Comment, "enc:") {
+		return true
+	}
+	for _, sig := range check.Signatures {
+		if sig.Comment != "" && !strings.HasPrefix(sig.Comment, "enc:") {
+			return true
+		}
+	}
+	return false
+}
+
+func has_step(route []int, step int) bool {
+	for _, s := range route {
+		if s == step {
+			return true
+		}
+	}
+	return false
+}
+
+func is_decided(check CheckInfo) bool {
+	return check.Review == Success || check.Review == Failure
+}
+
+func max_int(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -56,6 +56,7 @@ fcw.enrollWithAdminCert(cp.makeEnrollmentOptionsUsingCert(), function (enrollErr
 			chaincode_id: chaincode_id,
 			chaincode_version: chaincode_ver,
 			cc_args: ['12345'],
+			collections_config: path.join(__dirname, '../chaincode/src/marbles/collections_config.json'),
 			peer_tls_opts: cp.getPeerTlsCertOpts(first_peer)
 		};
 		fcw.instantiate_chaincode(enrollResp, opts, function (err, resp) {
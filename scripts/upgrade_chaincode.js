@@ -56,6 +56,7 @@ fcw.enrollWithAdminCert(cp.makeEnrollmentOptionsUsingCert(), function (enrollErr
 			chaincode_version: chaincode_ver,
 			peer_tls_opts: cp.getPeerTlsCertOpts(first_peer),
 			cc_args: ['666666'],
+			collections_config: path.join(__dirname, '../chaincode/src/marbles/collections_config.json'),
 		};
 		fcw.upgrade_chaincode(enrollResp, opts, function (err, resp) {
 			console.log('---------------------------------------');
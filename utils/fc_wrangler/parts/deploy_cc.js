@@ -70,6 +70,7 @@ module.exports = function (logger) {
 					endorsed_hook: function(error, res){},
 					ordered_hook: function(error, res){},
 					cc_args: ["argument 1"],
+					collections_config: "path to collections_config.json",				<optional, private data>
 					peer_tls_opts: {
 						pem: 'complete tls certificate',									<required if using ssl>
 						ssl-target-name-override: 'common name used in pem certificate' 	<required if using ssl>
@@ -94,6 +95,9 @@ module.exports = function (logger) {
 			args: options.cc_args,
 			txId: client.newTransactionID(),
 		};
+		if (options.collections_config) {
+			request['collections-config'] = options.collections_config;
+		}
 		logger.debug('[fcw] Sending instantiate req', request);
 
 		channel.initialize().then(() => {
@@ -151,6 +155,7 @@ module.exports = function (logger) {
 					endorsed_hook: function(error, res){},
 					ordered_hook: function(error, res){},
 					cc_args: ["argument 1"],
+					collections_config: "path to collections_config.json",				<optional, private data>
 					peer_tls_opts: {
 						pem: 'complete tls certificate',									<required if using ssl>
 						ssl-target-name-override: 'common name used in pem certificate' 	<required if using ssl>
@@ -174,6 +179,9 @@ module.exports = function (logger) {
 			args: options.cc_args,
 			txId: client.newTransactionID(),
 		};
+		if (options.collections_config) {
+			request['collections-config'] = options.collections_config;
+		}
 		logger.debug('[fcw] Sending upgrade cc req', request);
 
 		channel.initialize().then(() => {